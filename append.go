@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"github.com/goccy/go-json"
+	"io"
+	"runtime"
+	"sort"
+	"sync"
+)
+
+// PointerUpdate is a new value of pi and lambda for an ST which was already in the cache
+type PointerUpdate struct {
+	Index  int `json:"index"`
+	Pi     int `json:"pi"`
+	Lambda int `json:"lambda"`
+}
+
+// ClusterChange describes the cluster which some of the new STs are in at a threshold.  Existing
+// clusters are named after their last ST in the cache.  If the new STs don't join an existing
+// cluster Joined is empty, if they join more than one the clusters have been merged.
+type ClusterChange struct {
+	Threshold int        `json:"threshold"`
+	STs       []CgmlstSt `json:"STs"`
+	Joined    []CgmlstSt `json:"joined"`
+	Merged    bool       `json:"merged"`
+}
+
+// AppendOutput is the difference between the cached clustering and the clustering with the new STs.
+// The new STs are given the indexes from Offset onwards.
+type AppendOutput struct {
+	Offset    int              `json:"offset"`
+	Sts       []CgmlstSt       `json:"STs"`
+	Pi        []int            `json:"pi"`
+	Lambda    []int            `json:"lambda"`
+	Updated   []PointerUpdate  `json:"updated"`
+	Edges     map[int][][2]int `json:"edges"`
+	Threshold int              `json:"threshold"`
+	Changes   []ClusterChange  `json:"changes"`
+}
+
+// scoreRows compares each of the STs from `from` onwards with all of the STs before it.  The rows
+// are arranged like the rows of ScoresStore.scores.  If the context is cancelled the workers skip
+// the remaining rows and a CANCELLED error is returned.
+func scoreRows(ctx context.Context, index *ProfilesMap, STs []CgmlstSt, from int, numWorkers int, progress chan ProgressEvent) ([][]int, error) {
+	if numWorkers <= 0 {
+		numWorkers = runtime.NumCPU() + 1
+	}
+	profiles := make([]int, len(STs))
+	for i, st := range STs {
+		profiles[i] = index.lookup[st]
+	}
+
+	progress <- ProgressEvent{SCORES_EXPECTED, (len(STs)*(len(STs)-1) - from*(from-1)) / 2}
+	rows := make([][]int, len(STs)-from)
+	jobs := make(chan int, len(rows))
+	for n := from; n < len(STs); n++ {
+		jobs <- n
+	}
+	close(jobs)
+
+	var wg sync.WaitGroup
+	for w := 0; w < numWorkers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			comparer := newComparer(*index)
+			for n := range jobs {
+				if ctx.Err() != nil {
+					continue
+				}
+				row := make([]int, n)
+				for i := range row {
+					row[i] = comparer.compare(profiles[n], profiles[i])
+				}
+				rows[n-from] = row
+				progress <- ProgressEvent{SCORE_CALCULATED, n}
+			}
+		}()
+	}
+	wg.Wait()
+	if ctx.Err() != nil {
+		return nil, cancelledError(ctx, PHASE_SCORING)
+	}
+	return rows, nil
+}
+
+// Append adds the STs which aren't already in the cache to the cached clustering.  Only the
+// distances from the new STs are calculated.  It returns the changes and the updated cache.  The
+// threshold can't be higher than the threshold of the cache because the cache doesn't know the
+// distances above it.  Only a single linkage clustering can be extended.  It stops with a CANCELLED
+// error if the context is cancelled.
+func Append(ctx context.Context, cache *Cache, index *ProfilesMap, STs []CgmlstSt, threshold int, numWorkers int, progress chan ProgressEvent) (output AppendOutput, updated *Cache, err error) {
+	nOld := len(cache.Sts)
+	if linkage, linkageErr := normaliseLinkage(cache.Linkage); linkageErr != nil || linkage != SINGLE_LINKAGE {
+		err = newPipelineError(INVALID_CACHE, "", "can't append to a cache made with %s linkage, only single linkage can be extended", cache.Linkage)
+		return
+	}
+	if err = cache.Validate(); err != nil {
+		return
+	}
+	if nOld > 0 && cache.Threshold < threshold {
+		threshold = cache.Threshold
+	}
+
+	allSTs := make([]CgmlstSt, 0, nOld+len(STs))
+	seen := make(map[CgmlstSt]bool, nOld+len(STs))
+	for _, st := range cache.Sts {
+		seen[st] = true
+		allSTs = append(allSTs, st)
+	}
+	for _, st := range STs {
+		if !seen[st] {
+			seen[st] = true
+			allSTs = append(allSTs, st)
+		}
+	}
+	if _, err = index.Subset(allSTs); err != nil {
+		return
+	}
+	nItems := len(allSTs)
+
+	rows, err := scoreRows(ctx, index, allSTs, nOld, numWorkers, progress)
+	if err != nil {
+		return
+	}
+
+	progress <- ProgressEvent{CLUSTERING_STARTED, nItems - nOld}
+	previous := Clusters{cache.Pi, cache.Lambda, nOld}
+	clusters := Clusters{make([]int, nItems), make([]int, nItems), nItems}
+	copy(clusters.pi, cache.Pi)
+	copy(clusters.lambda, cache.Lambda)
+	if err = clusters.extend(ctx, nOld, func(n int, M []int) {
+		copy(M, rows[n-nOld])
+		progress <- ProgressEvent{STS_CLUSTERED, 1}
+	}); err != nil {
+		return
+	}
+
+	output = AppendOutput{
+		Offset:    nOld,
+		Sts:       allSTs[nOld:],
+		Pi:        clusters.pi[nOld:],
+		Lambda:    clusters.lambda[nOld:],
+		Updated:   []PointerUpdate{},
+		Edges:     map[int][][2]int{},
+		Threshold: threshold,
+	}
+	for i := 0; i < nOld; i++ {
+		if clusters.pi[i] != cache.Pi[i] || clusters.lambda[i] != cache.Lambda[i] {
+			output.Updated = append(output.Updated, PointerUpdate{i, clusters.pi[i], clusters.lambda[i]})
+		}
+	}
+	for t := 0; t <= threshold; t++ {
+		output.Edges[t] = [][2]int{}
+	}
+	for n, row := range rows {
+		for i, distance := range row {
+			if distance <= threshold {
+				output.Edges[distance] = append(output.Edges[distance], [2]int{i, n + nOld})
+			}
+		}
+	}
+	output.Changes = newcomerChanges(previous, clusters, allSTs, threshold)
+
+	updated = NewCache()
+	updated.Linkage = cache.Linkage
+	updated.Sts = allSTs
+	updated.Pi = clusters.pi
+	updated.Lambda = clusters.lambda
+	updated.Threshold = threshold
+	for t := 0; t <= threshold; t++ {
+		updated.Edges[t] = append(append([][2]int{}, cache.Edges[t]...), output.Edges[t]...)
+	}
+	return
+}
+
+// newcomerChanges finds the clusters which the STs after the previous clustering are in at each
+// threshold and which of the previous clusters they joined.
+func newcomerChanges(previous Clusters, clusters Clusters, STs []CgmlstSt, threshold int) []ClusterChange {
+	nOld := previous.nItems
+	changes := make([]ClusterChange, 0)
+	for t := 0; t <= threshold; t++ {
+		before := previous.Get(t)
+		after := clusters.Get(t)
+
+		joined := make(map[int]map[int]bool)
+		for i := 0; i < nOld; i++ {
+			if joined[after[i]] == nil {
+				joined[after[i]] = make(map[int]bool)
+			}
+			joined[after[i]][before[i]] = true
+		}
+
+		byCluster := make(map[int]*ClusterChange)
+		order := make([]int, 0)
+		for n := nOld; n < clusters.nItems; n++ {
+			change, found := byCluster[after[n]]
+			if !found {
+				change = &ClusterChange{Threshold: t, STs: []CgmlstSt{}, Joined: []CgmlstSt{}}
+				oldClusters := make([]int, 0, len(joined[after[n]]))
+				for c := range joined[after[n]] {
+					oldClusters = append(oldClusters, c)
+				}
+				sort.Ints(oldClusters)
+				for _, c := range oldClusters {
+					change.Joined = append(change.Joined, STs[c])
+				}
+				change.Merged = len(change.Joined) > 1
+				byCluster[after[n]] = change
+				order = append(order, after[n])
+			}
+			change.STs = append(change.STs, STs[n])
+		}
+		for _, c := range order {
+			changes = append(changes, *byCluster[c])
+		}
+	}
+	return changes
+}
+
+func runAppend(args []string) int {
+	var p pipelineFlags
+	flags := newFlagSet("append")
+	// Append only scores the new STs so it can't be lenient, checkpointed or streamed
+	p.registerBasic(flags)
+	cacheOut := flags.String("cache-out", "", "write the updated clustering to this file so it can be used as a cache")
+	r, w, code := parseFlags(flags, args, &p.output)
+	if code != EXIT_OK {
+		return code
+	}
+	defer r.Close()
+	defer w.Close()
+	ctx, cancel := p.context()
+	defer cancel()
+
+	progress, stopProgress := backgroundProgress(p.verbose)
+	defer stopProgress()
+	request, cache, indexer, err := parseAppendInput(ctx, r, p.cacheIn, progress)
+	if err != nil {
+		return fail(err)
+	}
+	if p.threshold >= 0 {
+		request.Threshold = p.threshold
+	}
+
+	output, updated, err := Append(ctx, &cache, indexer.index, request.STs, request.Threshold, p.workers, progress)
+	if err != nil {
+		return fail(err)
+	}
+	if *cacheOut != "" {
+		if err = WriteCacheFile(*cacheOut, updated.Output()); err != nil {
+			return fail(err)
+		}
+	}
+	if err = json.NewEncoder(w).Encode(output); err != nil {
+		return fail(err)
+	}
+	return EXIT_OK
+}
+
+// parseAppendInput is like parse but also indexes the profiles of the STs in the cache
+// which aren't in the request.
+func parseAppendInput(ctx context.Context, r io.Reader, cachePath string, progress chan ProgressEvent) (request Request, cache Cache, indexer *Indexer, err error) {
+	decoder := json.NewDecoder(r)
+	if request, cache, err = parseRequest(decoder, cachePath, progress); err != nil {
+		return
+	}
+	indexer = NewIndexer(append(append([]CgmlstSt{}, cache.Sts...), request.STs...))
+	indexer.CheckDuplicates()
+	if err = parseProfiles(ctx, decoder, indexer.Index, nil, progress); err != nil {
+		return
+	}
+	err = indexer.ResolveDuplicates(request.Duplicates)
+	return
+}
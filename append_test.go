@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestAppend(t *testing.T) {
+	progress, stopProgress := backgroundProgress(false)
+	defer stopProgress()
+	request, _, indexer, err := parse(context.Background(), fakeInput(`{"STs": ["A", "B", "C", "D", "E"], "Threshold": 3}`, "{}", fakeProfiles), "", progress)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A-1-B-2-C
+	cache := Cache{
+		Sts:       []CgmlstSt{"A", "B", "C"},
+		Pi:        []int{1, 2, 2},
+		Lambda:    []int{1, 2, ALMOST_INF},
+		Threshold: 3,
+		Edges:     map[int][][2]int{0: {}, 1: {{0, 1}}, 2: {{1, 2}}, 3: {{0, 2}}},
+	}
+
+	output, updated, err := Append(context.Background(), &cache, indexer.index, []CgmlstSt{"C", "D", "E"}, request.Threshold, 2, progress)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	scores, err := NewScores(request, NewCache(), indexer.index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done, _ := scores.RunScoring(context.Background(), *indexer.index, 2, progress)
+	<-done
+	expected, err := ClusterFromScratch(scores.scores, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(updated.Sts, []CgmlstSt{"A", "B", "C", "D", "E"}) {
+		t.Fatalf("Unexpected STs %v", updated.Sts)
+	}
+	compareSlices(t, updated.Pi, expected.pi)
+	compareSlices(t, updated.Lambda, expected.lambda)
+
+	if output.Offset != 3 || !reflect.DeepEqual(output.Sts, []CgmlstSt{"D", "E"}) {
+		t.Fatalf("Unexpected new STs %d %v", output.Offset, output.Sts)
+	}
+	compareSlices(t, output.Pi, expected.pi[3:])
+	compareSlices(t, output.Lambda, expected.lambda[3:])
+	for _, u := range output.Updated {
+		if u.Pi != expected.pi[u.Index] || u.Lambda != expected.lambda[u.Index] {
+			t.Fatalf("Unexpected update %v", u)
+		}
+	}
+
+	expectedEdges := map[int][][2]int{0: {}, 1: {{2, 4}}, 2: {}, 3: {{2, 3}, {0, 4}, {1, 4}}}
+	if !reflect.DeepEqual(output.Edges, expectedEdges) {
+		t.Fatalf("Expected %v, got %v", expectedEdges, output.Edges)
+	}
+	if !reflect.DeepEqual(updated.Edges[3], [][2]int{{0, 2}, {2, 3}, {0, 4}, {1, 4}}) {
+		t.Fatalf("Unexpected cached edges %v", updated.Edges[3])
+	}
+
+	expectedChanges := []ClusterChange{
+		{0, []CgmlstSt{"D"}, []CgmlstSt{}, false},
+		{0, []CgmlstSt{"E"}, []CgmlstSt{}, false},
+		{1, []CgmlstSt{"D"}, []CgmlstSt{}, false},
+		{1, []CgmlstSt{"E"}, []CgmlstSt{"C"}, false},
+		{2, []CgmlstSt{"D"}, []CgmlstSt{}, false},
+		{2, []CgmlstSt{"E"}, []CgmlstSt{"C"}, false},
+		{3, []CgmlstSt{"D", "E"}, []CgmlstSt{"C"}, false},
+	}
+	if !reflect.DeepEqual(output.Changes, expectedChanges) {
+		t.Fatalf("Expected %v, got %v", expectedChanges, output.Changes)
+	}
+}
+
+func TestAppendMerge(t *testing.T) {
+	// A and C are 2 apart but E is 1 away from each of them
+	profiles := map[CgmlstSt][]string{
+		"A": {"1", "1", "1", "1"},
+		"C": {"1", "1", "2", "2"},
+		"E": {"1", "1", "1", "2"},
+	}
+	progress, stopProgress := backgroundProgress(false)
+	defer stopProgress()
+	_, _, indexer, err := parse(context.Background(), fakeInput(`{"STs": ["A", "C", "E"], "Threshold": 1}`, "{}", profiles), "", progress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache := Cache{Sts: []CgmlstSt{"A", "C"}, Pi: []int{1, 1}, Lambda: []int{2, ALMOST_INF}, Threshold: 2}
+
+	output, _, err := Append(context.Background(), &cache, indexer.index, []CgmlstSt{"E"}, 1, 1, progress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := ClusterChange{1, []CgmlstSt{"E"}, []CgmlstSt{"A", "C"}, true}
+	if !reflect.DeepEqual(output.Changes[1], expected) {
+		t.Fatalf("Expected %v, got %v", expected, output.Changes[1])
+	}
+}
+
+func TestAppendToOtherLinkage(t *testing.T) {
+	progress, stopProgress := backgroundProgress(false)
+	defer stopProgress()
+	_, _, indexer, err := parse(context.Background(), fakeInput(`{"STs": ["A", "B", "C"], "Threshold": 3}`, "{}", fakeProfiles), "", progress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache := Cache{Sts: []CgmlstSt{"A", "B"}, Pi: []int{1, 1}, Lambda: []int{1, ALMOST_INF}, Threshold: 3, Linkage: AVERAGE_LINKAGE}
+	_, _, err = Append(context.Background(), &cache, indexer.index, []CgmlstSt{"C"}, 3, 1, progress)
+	if pipelineErr, ok := err.(*PipelineError); !ok || pipelineErr.Code != INVALID_CACHE {
+		t.Fatalf("Expected an INVALID_CACHE error, got %v", err)
+	}
+
+	cache.Linkage = SINGLE_LINKAGE
+	if _, updated, err := Append(context.Background(), &cache, indexer.index, []CgmlstSt{"C"}, 3, 1, progress); err != nil || updated.Linkage != SINGLE_LINKAGE {
+		t.Fatalf("Expected the linkage to be kept, got %v %v", updated, err)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"github.com/goccy/go-json"
+	"os"
+	"path/filepath"
+)
+
+// ReadCacheFile loads a cache written by WriteCacheFile.  It uses the same schema as the cache
+// document which can be given as the second document on stdin.
+func ReadCacheFile(path string) (cache Cache, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	err = json.NewDecoder(f).Decode(&cache)
+	return
+}
+
+// WriteCacheFile saves the output of a clustering so that it can be given as the cache of a later
+// run.  The file is written next to its destination and then renamed so that a reader never sees
+// a partially written cache.
+func WriteCacheFile(path string, output ClusterOutput) (err error) {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			_ = os.Remove(f.Name())
+		}
+	}()
+	if err = json.NewEncoder(f).Encode(output); err != nil {
+		_ = f.Close()
+		return
+	}
+	if err = f.Close(); err != nil {
+		return
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// NewCacheOutput returns an empty document which the outputs of Format can be merged into.
+func NewCacheOutput() ClusterOutput {
+	return ClusterOutput{Edges: map[int][][2]int{}, Pi: []int{}, Lambda: []int{}, Sts: []CgmlstSt{}}
+}
+
+// Merge adds the edges or the clustering from one of the documents returned by Format.  A distance
+// without any pairs is kept as an empty list so that the cache file doesn't have null edges.
+func (o *ClusterOutput) Merge(doc ClusterOutput) {
+	for distance, pairs := range doc.Edges {
+		if o.Edges[distance] == nil {
+			o.Edges[distance] = [][2]int{}
+		}
+		o.Edges[distance] = append(o.Edges[distance], pairs...)
+	}
+	if len(doc.Sts) > 0 {
+		o.Pi = doc.Pi
+		o.Lambda = doc.Lambda
+		o.Sts = doc.Sts
+		o.Linkage = doc.Linkage
+	}
+	o.Threshold = doc.Threshold
+}
+
+// Cache converts the merged output into a cache for the next clustering.
+func (o ClusterOutput) Cache() *Cache {
+	cache := NewCache()
+	cache.Edges = o.Edges
+	cache.Pi = o.Pi
+	cache.Lambda = o.Lambda
+	cache.Sts = o.Sts
+	cache.Threshold = o.Threshold
+	cache.Linkage = o.Linkage
+	return cache
+}
+
+// Output converts the cache into the document written by WriteCacheFile.
+func (c *Cache) Output() ClusterOutput {
+	output := ClusterOutput{Edges: c.Edges, Pi: c.Pi, Lambda: c.Lambda, Sts: c.Sts, Threshold: c.Threshold}
+	if c.Linkage != SINGLE_LINKAGE {
+		output.Linkage = c.Linkage
+	}
+	return output
+}
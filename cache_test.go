@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func fakeInput(request string, cache string, profiles map[CgmlstSt][]string) io.Reader {
+	var b strings.Builder
+	b.WriteString(request)
+	b.WriteString("\n")
+	if cache != "" {
+		b.WriteString(cache)
+		b.WriteString("\n")
+	}
+	for st, matches := range profiles {
+		doc, _ := json.Marshal(Profile{ST: st, Matches: matches})
+		b.Write(doc)
+		b.WriteString("\n")
+	}
+	return strings.NewReader(b.String())
+}
+
+var fakeProfiles = map[CgmlstSt][]string{
+	"A": {"1", "1", "1", "1", "1", "1"},
+	"B": {"1", "1", "1", "1", "1", "2"},
+	"C": {"1", "1", "1", "2", "2", "2"},
+	"D": {"2", "2", "2", "2", "2", "2"},
+	"E": {"1", "1", "1", "2", "2", "3"},
+}
+
+func TestCacheFileRoundTrip(t *testing.T) {
+	cachePath := filepath.Join(t.TempDir(), "cache.json")
+
+	first := fakeInput(`{"STs": ["A", "B", "C"], "Threshold": 3}`, "{}", fakeProfiles)
+	STs, clusters, _, err := _main(context.Background(), first, &bytes.Buffer{}, Options{CacheOut: cachePath})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cache, err := ReadCacheFile(cachePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(cache.Sts, STs) {
+		t.Fatalf("Expected %v, got %v", STs, cache.Sts)
+	}
+	compareSlices(t, cache.Pi, clusters.pi)
+	compareSlices(t, cache.Lambda, clusters.lambda)
+	if cache.Threshold != 3 {
+		t.Fatalf("Expected threshold 3, got %d", cache.Threshold)
+	}
+	expectedEdges := map[int][][2]int{0: {}, 1: {{0, 1}}, 2: {{1, 2}}, 3: {{0, 2}}}
+	if !reflect.DeepEqual(cache.Edges, expectedEdges) {
+		t.Fatalf("Expected %v, got %v", expectedEdges, cache.Edges)
+	}
+
+	second := fakeInput(`{"STs": ["A", "B", "C", "D", "E"], "Threshold": 3}`, "", fakeProfiles)
+	STs, updated, _, err := _main(context.Background(), second, &bytes.Buffer{}, Options{CacheIn: cachePath})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fresh := fakeInput(`{"STs": ["A", "B", "C", "D", "E"], "Threshold": 3}`, "{}", fakeProfiles)
+	freshSTs, expected, _, err := _main(context.Background(), fresh, &bytes.Buffer{}, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(STs, freshSTs) {
+		t.Fatalf("Expected %v, got %v", freshSTs, STs)
+	}
+	compareSlices(t, updated.pi, expected.pi)
+	compareSlices(t, updated.lambda, expected.lambda)
+}
+
+func TestWriteCacheFile(t *testing.T) {
+	clusters, err := ClusterFromScratch([]int{1, 3, 2}, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	output := NewCacheOutput()
+	for doc := range clusters.Format(context.Background(), 3, []int{1, 3, 2}, []CgmlstSt{"A", "B", "C"}) {
+		output.Merge(doc)
+	}
+
+	cachePath := filepath.Join(t.TempDir(), "cache.json")
+	if err = WriteCacheFile(cachePath, output); err != nil {
+		t.Fatal(err)
+	}
+	written, err := os.ReadFile(cachePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(written, []byte("null")) {
+		t.Fatalf("Expected the distances without edges to be empty lists, got %s", written)
+	}
+
+	cache, err := ReadCacheFile(cachePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := output.Cache(); !reflect.DeepEqual(&cache, expected) {
+		t.Fatalf("Expected %+v, got %+v", expected, &cache)
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"github.com/goccy/go-json"
+	"io"
+	"testing"
+	"time"
+)
+
+// lastDocuments decodes the output and returns the last n documents.
+func lastDocuments(t *testing.T, output io.Reader, n int) []map[string]json.RawMessage {
+	docs := make([]map[string]json.RawMessage, 0)
+	decoder := json.NewDecoder(output)
+	for {
+		var doc map[string]json.RawMessage
+		if err := decoder.Decode(&doc); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		docs = append(docs, doc)
+	}
+	if len(docs) < n {
+		t.Fatalf("Expected at least %d documents, got %d", n, len(docs))
+	}
+	return docs[len(docs)-n:]
+}
+
+func TestCancelled(t *testing.T) {
+	request := `{"STs": ["A", "B", "C", "D", "E"], "Threshold": 3}`
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	var output bytes.Buffer
+	_, _, _, err := _main(ctx, fakeInput(request, "{}", fakeProfiles), &output, Options{})
+	if code := exitCode(err); code != exitCodes[CANCELLED] {
+		t.Fatalf("Expected exit code %d, got %d (%v)", exitCodes[CANCELLED], code, err)
+	}
+
+	docs := lastDocuments(t, &output, 2)
+	var progress ProgressMessage
+	raw, _ := json.Marshal(docs[0])
+	if err := json.Unmarshal(raw, &progress); err != nil || progress.Message != "Cancelled" {
+		t.Fatalf("Expected a cancelled progress message, got %s", raw)
+	}
+	var pipelineErr PipelineError
+	if err := json.Unmarshal(docs[1]["error"], &pipelineErr); err != nil {
+		t.Fatal(err)
+	}
+	if pipelineErr.Code != CANCELLED || pipelineErr.Phase != PHASE_PARSING || pipelineErr.Message != "the run was cancelled" {
+		t.Fatalf("Expected the run to be cancelled while parsing, got %+v", pipelineErr)
+	}
+
+	output.Reset()
+	_, _, _, err = _main(context.Background(), fakeInput(request, "{}", fakeProfiles), &output, Options{MaxRuntime: time.Nanosecond})
+	if pipelineErr, ok := err.(*PipelineError); !ok || pipelineErr.Code != CANCELLED || pipelineErr.Message != "the maximum runtime was exceeded" {
+		t.Fatalf("Expected the maximum runtime to be exceeded, got %v", err)
+	}
+}
+
+func TestCancelledStages(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	progress, stopProgress := backgroundProgress(false)
+	defer stopProgress()
+
+	distances := []int{1, 2, 3, 4, 5, 6}
+	if _, err := ClusterFromCache(ctx, distances, 4, NewCache()); !isCancelled(err) {
+		t.Fatalf("Expected clustering to be cancelled, got %v", err)
+	}
+
+	if _, err := Agglomerate(ctx, distances, 4, COMPLETE_LINKAGE); !isCancelled(err) {
+		t.Fatalf("Expected complete linkage to be cancelled, got %v", err)
+	}
+	if _, err := NeighbourJoining(ctx, distances, 4, progress); !isCancelled(err) {
+		t.Fatalf("Expected neighbour-joining to be cancelled, got %v", err)
+	}
+
+	clusters, err := ClusterFromScratch(distances, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	for range clusters.Format(ctx, 3, distances, []CgmlstSt{"A", "B", "C", "D"}) {
+		n++
+	}
+	if n > 0 {
+		t.Fatalf("Expected the output to stop, got %d documents", n)
+	}
+
+	request, _, indexer, err := parse(context.Background(), fakeInput(`{"STs": ["A", "B", "C", "D", "E"], "Threshold": 3}`, "{}", fakeProfiles), "", progress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	scores, err := NewScores(request, NewCache(), indexer.index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done, _ := scores.RunScoring(ctx, *indexer.index, 2, progress)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the workers to stop")
+	}
+	if scores.Todo() == 0 {
+		t.Fatal("Expected the scores to be left unfinished")
+	}
+
+	cache := NewCache()
+	if _, _, err := Append(ctx, cache, indexer.index, request.STs, 3, 2, progress); !isCancelled(err) {
+		t.Fatalf("Expected appending to be cancelled, got %v", err)
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"fmt"
+	"github.com/goccy/go-json"
+	"log"
+	"sort"
+)
+
+// ClusterDelta is a cluster of the new run which isn't the same as a cluster of the previous run.
+// Clusters are named after their last ST in the run they are from.  Kind is "new" if none of its
+// STs were in the previous run, "merged" if they were in more than one previous cluster, otherwise
+// "grown".
+type ClusterDelta struct {
+	Kind    string     `json:"kind"`
+	Cluster CgmlstSt   `json:"cluster"`
+	From    []CgmlstSt `json:"from"`  // the previous clusters of its STs
+	Added   []CgmlstSt `json:"added"` // its STs which weren't in the previous run
+}
+
+// ClusterSplit is a previous cluster whose STs are now in more than one cluster.  This can only
+// happen if some of its STs were removed.
+type ClusterSplit struct {
+	Cluster CgmlstSt   `json:"cluster"`
+	Into    []CgmlstSt `json:"into"`
+}
+
+// ClusterRemoval lists the STs of a previous cluster which aren't in the new run.
+type ClusterRemoval struct {
+	Cluster CgmlstSt   `json:"cluster"`
+	STs     []CgmlstSt `json:"STs"`
+}
+
+// MembershipChanges is the change log between two clusterings at a threshold.
+type MembershipChanges struct {
+	Threshold int              `json:"threshold"`
+	Clusters  []ClusterDelta   `json:"clusters"`
+	Splits    []ClusterSplit   `json:"splits"`
+	Removed   []ClusterRemoval `json:"removed"`
+}
+
+// sortedNames names the clusters with the given ids in the order of the ids.
+func sortedNames(ids map[int]bool, STs []CgmlstSt) []CgmlstSt {
+	order := make([]int, 0, len(ids))
+	for id := range ids {
+		order = append(order, id)
+	}
+	sort.Ints(order)
+	names := make([]CgmlstSt, len(order))
+	for i, id := range order {
+		names[i] = STs[id]
+	}
+	return names
+}
+
+// CompareClusterings finds how the clusters changed between two runs at each threshold.  The STs
+// are matched by name so they don't need to be in the same order.  The previous clustering only
+// knows the distances up to its threshold, known, so higher thresholds can't be compared.
+func CompareClusterings(previousSTs []CgmlstSt, previous Clusters, STs []CgmlstSt, clusters Clusters, thresholds []int, known int) ([]MembershipChanges, error) {
+	if len(previousSTs) != previous.nItems || len(STs) != clusters.nItems {
+		return nil, fmt.Errorf("expected %d and %d STs, got %d and %d", previous.nItems, clusters.nItems, len(previousSTs), len(STs))
+	}
+	for _, t := range thresholds {
+		if t > known {
+			return nil, newPipelineError(INVALID_INPUT, "", "can't compare the clusters at %d, which is above the cache's threshold of %d", t, known)
+		}
+	}
+	previousIndex := make(map[CgmlstSt]int, len(previousSTs))
+	for i, st := range previousSTs {
+		previousIndex[st] = i
+	}
+	inNew := make(map[CgmlstSt]bool, len(STs))
+	for _, st := range STs {
+		inNew[st] = true
+	}
+
+	changes := make([]MembershipChanges, 0, len(thresholds))
+	for _, t := range thresholds {
+		before := previous.Get(t)
+		after := clusters.Get(t)
+		change := MembershipChanges{Threshold: t, Clusters: []ClusterDelta{}, Splits: []ClusterSplit{}, Removed: []ClusterRemoval{}}
+
+		from := make(map[int]map[int]bool) // new cluster to previous clusters
+		into := make(map[int]map[int]bool) // previous cluster to new clusters
+		added := make(map[int][]CgmlstSt)
+		order := make([]int, 0)
+		for i, st := range STs {
+			c := after[i]
+			if _, seen := from[c]; !seen {
+				from[c] = make(map[int]bool)
+				order = append(order, c)
+			}
+			p, found := previousIndex[st]
+			if !found {
+				added[c] = append(added[c], st)
+				continue
+			}
+			from[c][before[p]] = true
+			if into[before[p]] == nil {
+				into[before[p]] = make(map[int]bool)
+			}
+			into[before[p]][c] = true
+		}
+		for _, c := range order {
+			delta := ClusterDelta{Cluster: STs[c], From: sortedNames(from[c], previousSTs), Added: added[c]}
+			if delta.Added == nil {
+				delta.Added = []CgmlstSt{}
+			}
+			switch {
+			case len(delta.From) == 0:
+				delta.Kind = "new"
+			case len(delta.From) > 1:
+				delta.Kind = "merged"
+			case len(delta.Added) > 0:
+				delta.Kind = "grown"
+			default:
+				continue
+			}
+			change.Clusters = append(change.Clusters, delta)
+		}
+
+		removed := make(map[int][]CgmlstSt)
+		removedOrder := make([]int, 0)
+		for p, st := range previousSTs {
+			if inNew[st] {
+				continue
+			}
+			if _, seen := removed[before[p]]; !seen {
+				removedOrder = append(removedOrder, before[p])
+			}
+			removed[before[p]] = append(removed[before[p]], st)
+		}
+		sort.Ints(removedOrder)
+		for _, p := range removedOrder {
+			change.Removed = append(change.Removed, ClusterRemoval{previousSTs[p], removed[p]})
+			if len(into[p]) > 1 {
+				change.Splits = append(change.Splits, ClusterSplit{previousSTs[p], sortedNames(into[p], STs)})
+			}
+		}
+		changes = append(changes, change)
+	}
+	return changes, nil
+}
+
+func runChanges(args []string) int {
+	var p pipelineFlags
+	flags := newFlagSet("changes")
+	p.register(flags)
+	thresholdList := flags.String("thresholds", "", "comma separated thresholds to compare (default 0 to the request's threshold)")
+	r, w, code := parseFlags(flags, args, &p.output)
+	if code != EXIT_OK {
+		return code
+	}
+	defer r.Close()
+	defer w.Close()
+	ctx, cancel := p.context()
+	defer cancel()
+
+	progress, stopProgress := backgroundProgress(p.verbose)
+	defer stopProgress()
+	opts := p.options()
+	request, cache, indexer, err := parseChecked(ctx, r, opts.CacheIn, planRequest(opts, false), progress)
+	if err != nil {
+		return fail(err)
+	}
+	opts.apply(&request)
+	if err = cache.Validate(); err != nil {
+		return fail(err)
+	}
+	known := ALMOST_INF
+	if len(cache.Sts) > 0 {
+		known = cache.Threshold
+	}
+	maxThreshold := request.Threshold
+	if *thresholdList == "" && maxThreshold > known {
+		log.Printf("The cache only goes up to %d so the clusters are compared up to that threshold\n", known)
+		maxThreshold = known
+	}
+	thresholds, err := parseThresholds(*thresholdList, maxThreshold)
+	if err != nil {
+		return fail(err)
+	}
+
+	scores, err := runScores(ctx, request, &cache, indexer.index, opts, progress)
+	if err != nil {
+		return fail(err)
+	}
+	clusters, _, err := clusterScores(ctx, &scores, &cache, request.Linkage, progress)
+	if err != nil {
+		return fail(err)
+	}
+	previous := Clusters{cache.Pi, cache.Lambda, len(cache.Sts)}
+	changes, err := CompareClusterings(cache.Sts, previous, scores.STs, clusters, thresholds, known)
+	if err != nil {
+		return fail(err)
+	}
+
+	encoder := json.NewEncoder(w)
+	for _, change := range changes {
+		if err = encoder.Encode(change); err != nil {
+			return fail(err)
+		}
+	}
+	return EXIT_OK
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCompareClusterings(t *testing.T) {
+	// A-1-B-2-C
+	previous := Clusters{[]int{1, 2, 2}, []int{1, 2, ALMOST_INF}, 3}
+
+	// B has been removed and E is 1 from C
+	STs := []CgmlstSt{"A", "C", "E", "D"}
+	clusters, err := ClusterFromScratch([]int{
+		3,
+		3, 1,
+		6, 3, 4,
+	}, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	changes, err := CompareClusterings([]CgmlstSt{"A", "B", "C"}, previous, STs, clusters, []int{0, 2}, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []MembershipChanges{
+		{
+			Threshold: 0,
+			Clusters: []ClusterDelta{
+				{"new", "E", []CgmlstSt{}, []CgmlstSt{"E"}},
+				{"new", "D", []CgmlstSt{}, []CgmlstSt{"D"}},
+			},
+			Splits:  []ClusterSplit{},
+			Removed: []ClusterRemoval{{"B", []CgmlstSt{"B"}}},
+		},
+		{
+			Threshold: 2,
+			Clusters: []ClusterDelta{
+				{"grown", "E", []CgmlstSt{"C"}, []CgmlstSt{"E"}},
+				{"new", "D", []CgmlstSt{}, []CgmlstSt{"D"}},
+			},
+			Splits:  []ClusterSplit{{"C", []CgmlstSt{"A", "E"}}},
+			Removed: []ClusterRemoval{{"C", []CgmlstSt{"B"}}},
+		},
+	}
+	if !reflect.DeepEqual(changes, expected) {
+		t.Fatalf("Expected %v, got %v", expected, changes)
+	}
+
+	// Adding E between A and C merges them at 1
+	previous = Clusters{[]int{1, 1}, []int{2, ALMOST_INF}, 2}
+	if clusters, err = ClusterFromScratch([]int{2, 1, 1}, 3); err != nil {
+		t.Fatal(err)
+	}
+	if changes, err = CompareClusterings([]CgmlstSt{"A", "C"}, previous, []CgmlstSt{"A", "C", "E"}, clusters, []int{1}, 2); err != nil {
+		t.Fatal(err)
+	}
+	merged := ClusterDelta{"merged", "E", []CgmlstSt{"A", "C"}, []CgmlstSt{"E"}}
+	if len(changes[0].Clusters) != 1 || !reflect.DeepEqual(changes[0].Clusters[0], merged) {
+		t.Fatalf("Expected %v, got %v", merged, changes[0].Clusters)
+	}
+
+	// The cache doesn't know which clusters A and C were in at 3
+	_, err = CompareClusterings([]CgmlstSt{"A", "C"}, previous, []CgmlstSt{"A", "C", "E"}, clusters, []int{1, 3}, 2)
+	if pipelineErr, ok := err.(*PipelineError); !ok || pipelineErr.Code != INVALID_INPUT {
+		t.Fatalf("Expected an INVALID_INPUT error, got %v", err)
+	}
+}
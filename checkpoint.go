@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"github.com/goccy/go-json"
+	"hash/fnv"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// CHECKPOINT_VERSION changes whenever the format of the checkpoint files does.
+const CHECKPOINT_VERSION = 1
+
+// CHECKPOINT_INTERVAL is how often the scores are checkpointed if no interval is given.
+const CHECKPOINT_INTERVAL = 10 * time.Minute
+
+// checkpointHeader is the first line of a checkpoint file.  It's followed by the scores of each of
+// the rows, in order, as little-endian int32s.  Row n holds the distances from STs 0 to n-1 to ST n.
+type checkpointHeader struct {
+	Version   int        `json:"version"`
+	STs       []CgmlstSt `json:"STs"`
+	CacheSize int        `json:"cacheSize"`
+	Profiles  string     `json:"profiles"` // the fingerprint of the profiles of the STs
+	Rows      []int      `json:"rows"`
+}
+
+// Fingerprint hashes the profiles of the STs in order so that a checkpoint can't be resumed with
+// different profiles.
+func (i *ProfilesMap) Fingerprint(STs []CgmlstSt) string {
+	hash := fnv.New64a()
+	buf := make([]byte, 8)
+	for _, st := range STs {
+		hash.Write([]byte(st))
+		binary.LittleEndian.PutUint64(buf, i.hashes[st])
+		hash.Write(buf)
+	}
+	return strconv.FormatUint(hash.Sum64(), 16)
+}
+
+// WriteCheckpoint saves the rows which have been scored.  It can be called while the workers are
+// running.  The file is replaced in one step so that a checkpoint is never left half written.
+func (s *ScoresStore) WriteCheckpoint(path string, fingerprint string) (err error) {
+	header := checkpointHeader{CHECKPOINT_VERSION, s.STs, s.cacheSize, fingerprint, []int{}}
+	for row := range s.scored {
+		if atomic.LoadInt32(&s.scored[row]) == 1 {
+			header.Rows = append(header.Rows, row)
+		}
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+	w := bufio.NewWriter(f)
+	if err = json.NewEncoder(w).Encode(header); err != nil {
+		return
+	}
+	value := make([]byte, 4)
+	for _, row := range header.Rows {
+		start := row * (row - 1) / 2
+		for _, score := range s.scores[start : start+row] {
+			binary.LittleEndian.PutUint32(value, uint32(int32(score)))
+			if _, err = w.Write(value); err != nil {
+				return
+			}
+		}
+	}
+	if err = w.Flush(); err != nil {
+		return
+	}
+	if err = f.Close(); err != nil {
+		return
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// ResumeCheckpoint loads the rows which had been scored so that RunScoring skips them.  It returns
+// the number of rows loaded, or an error if the checkpoint was made for different STs or profiles.
+func (s *ScoresStore) ResumeCheckpoint(path string, fingerprint string) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	line, err := r.ReadBytes('\n')
+	if err != nil {
+		return 0, newPipelineError(INVALID_CACHE, "", "couldn't read the checkpoint: %s", err)
+	}
+	var header checkpointHeader
+	if err = json.Unmarshal(line, &header); err != nil {
+		return 0, newPipelineError(INVALID_CACHE, "", "couldn't read the checkpoint: %s", err)
+	}
+
+	if header.Version != CHECKPOINT_VERSION {
+		return 0, newPipelineError(INVALID_CACHE, "", "expected a version %d checkpoint, got version %d", CHECKPOINT_VERSION, header.Version)
+	}
+	if len(header.STs) != len(s.STs) || header.CacheSize != s.cacheSize {
+		return 0, newPipelineError(INVALID_CACHE, "", "the checkpoint has %d STs (%d cached) but the run has %d (%d cached)", len(header.STs), header.CacheSize, len(s.STs), s.cacheSize)
+	}
+	for i, st := range header.STs {
+		if st != s.STs[i] {
+			return 0, newPipelineError(INVALID_CACHE, s.STs[i], "the checkpoint has ST '%s' where the run has '%s'", st, s.STs[i])
+		}
+	}
+	if header.Profiles != fingerprint {
+		return 0, newPipelineError(INVALID_CACHE, "", "the profiles don't match the checkpoint")
+	}
+
+	if s.scored == nil {
+		s.scored = make([]int32, len(s.STs))
+	}
+	first := max(s.cacheSize, 1)
+	for _, row := range header.Rows {
+		if row < first || row >= len(s.STs) {
+			return 0, newPipelineError(INVALID_CACHE, "", "the checkpoint has row %d but only rows %d to %d are scored", row, first, len(s.STs)-1)
+		}
+		values := make([]byte, 4*row)
+		if _, err = io.ReadFull(r, values); err != nil {
+			return 0, newPipelineError(INVALID_CACHE, "", "couldn't read row %d of the checkpoint: %s", row, err)
+		}
+		start := row * (row - 1) / 2
+		for j := 0; j < row; j++ {
+			s.scores[start+j] = int(int32(binary.LittleEndian.Uint32(values[4*j:])))
+		}
+		if s.scored[row] == 0 {
+			s.scored[row] = 1
+			s.todo -= int32(row)
+		}
+	}
+	return len(header.Rows), nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func scoreFakeProfiles(t *testing.T, profiles map[CgmlstSt][]string) (ScoresStore, *ProfilesMap) {
+	progress, stopProgress := backgroundProgress(false)
+	defer stopProgress()
+	request, _, indexer, err := parse(context.Background(), fakeInput(`{"STs": ["A", "B", "C", "D", "E"], "Threshold": 3}`, "{}", profiles), "", progress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	scores, err := NewScores(request, NewCache(), indexer.index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return scores, indexer.index
+}
+
+func TestCheckpoint(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "scores.checkpoint")
+	progress, stopProgress := backgroundProgress(false)
+	defer stopProgress()
+
+	complete, index := scoreFakeProfiles(t, fakeProfiles)
+	done, _ := complete.RunScoring(context.Background(), *index, 2, progress)
+	<-done
+	fingerprint := index.Fingerprint(complete.STs)
+
+	// Pretend that the last two rows weren't finished
+	complete.scored[3], complete.scored[4] = 0, 0
+	if err := complete.WriteCheckpoint(path, fingerprint); err != nil {
+		t.Fatal(err)
+	}
+
+	scores, index := scoreFakeProfiles(t, fakeProfiles)
+	rows, err := scores.ResumeCheckpoint(path, index.Fingerprint(scores.STs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rows != 2 {
+		t.Fatalf("Expected 2 rows to be resumed, got %d", rows)
+	}
+	if todo := scores.Todo(); todo != 3+4 {
+		t.Fatalf("Expected 7 scores to be left, got %d", todo)
+	}
+	if !reflect.DeepEqual(scores.scores[:3], complete.scores[:3]) {
+		t.Fatalf("Expected the resumed scores %v, got %v", complete.scores[:3], scores.scores[:3])
+	}
+
+	done, _ = scores.RunScoring(context.Background(), *index, 2, progress)
+	<-done
+	if scores.Todo() != 0 {
+		t.Fatalf("Expected every score to be calculated, %d are left", scores.Todo())
+	}
+	compareSlices(t, scores.scores, complete.scores)
+}
+
+func TestCheckpointMismatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "scores.checkpoint")
+	scores, index := scoreFakeProfiles(t, fakeProfiles)
+	if err := scores.WriteCheckpoint(path, index.Fingerprint(scores.STs)); err != nil {
+		t.Fatal(err)
+	}
+
+	changed := make(map[CgmlstSt][]string)
+	for st, profile := range fakeProfiles {
+		changed[st] = profile
+	}
+	changed["E"] = []string{"1", "1", "1", "2", "2", "4"}
+	scores, index = scoreFakeProfiles(t, changed)
+	_, err := scores.ResumeCheckpoint(path, index.Fingerprint(scores.STs))
+	if pipelineErr, ok := err.(*PipelineError); !ok || pipelineErr.Code != INVALID_CACHE {
+		t.Fatalf("Expected an invalid checkpoint, got %v", err)
+	}
+
+	scores, index = scoreFakeProfiles(t, fakeProfiles)
+	scores.STs[0], scores.STs[1] = scores.STs[1], scores.STs[0]
+	_, err = scores.ResumeCheckpoint(path, index.Fingerprint(scores.STs))
+	if pipelineErr, ok := err.(*PipelineError); !ok || pipelineErr.Code != INVALID_CACHE || pipelineErr.ST != "B" {
+		t.Fatalf("Expected the order of the STs to be checked, got %v", err)
+	}
+}
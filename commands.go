@@ -0,0 +1,596 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Exit codes of the subcommands
+const (
+	EXIT_OK      = 0
+	EXIT_FAILURE = 1
+	EXIT_USAGE   = 64 // as in sysexits.h, Go exits with 2 when it panics
+)
+
+type command struct {
+	usage       string
+	description string
+	run         func(args []string) int
+}
+
+// commands are the subcommands which can be given as the first argument.  Without a subcommand
+// the request, cache and profiles are read from stdin as before.
+var commands map[string]command
+
+func init() {
+	commands = map[string]command{
+		"cluster":   {"cluster [flags] [input]", "Cluster the STs and write the edges and pi/lambda", runCluster},
+		"score":     {"score [flags] [input]", "Write the distances between STs up to the threshold", runScore},
+		"tree":      {"tree [flags] [input]", "Write the dendrogram as Newick or a list of merges", runTree},
+		"changes":   {"changes [-thresholds 5,10] [flags] [input]", "Compare the clusters with those in the cache", runChanges},
+		"consensus": {"consensus [-thresholds 5,10] [flags] [input]", "Write the consensus profile of each cluster", runConsensus},
+		"diff":      {"diff [-a ST -b ST] [flags] [input]", "List the loci which differ between two STs or every pair up to the threshold", runDiff},
+		"matrix":    {"matrix [-sts A,B] [flags] [input]", "Write the distance matrix as TSV, PHYLIP or MEGA", runMatrix},
+		"mst":       {"mst [flags] [input]", "Write the minimum spanning tree as an edge list or GraphML", runMst},
+		"nj":        {"nj [flags] [input]", "Write a neighbour-joining tree as Newick", runNj},
+		"recommend": {"recommend [-max 50] [flags] [input]", "Suggest thresholds from the distribution of the distances", runRecommend},
+		"query":     {"query (-st ST | -profile file) [flags] [input]", "Find the nearest neighbours of a genome and their clusters", runQuery},
+		"cache":     {"cache inspect [flags] [cache]", "Summarise a cache file", runCache},
+		"validate":  {"validate [flags] [input]", "Check the request, cache and profiles without scoring", runValidate},
+		"append":    {"append [flags] [input]", "Add new STs to the cached clustering and write the changes", runAppend},
+		"serve":     {"serve [-listen :8080] [-metrics :9090] [-workers N]", "Keep profiles in memory and cluster requests over HTTP", runServe},
+		"help":      {"help", "Show this message", runHelp},
+	}
+}
+
+func runHelp(args []string) int {
+	fmt.Fprintln(os.Stderr, "Usage: clustering [command] [flags] [input]")
+	fmt.Fprintln(os.Stderr, "\nThe input is the request, optionally the cache, and then the profiles (default stdin).")
+	fmt.Fprintln(os.Stderr, "Without a command the input is read from stdin and clustered.\n\nCommands:")
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-48s %s\n", commands[name].usage, commands[name].description)
+	}
+	return EXIT_OK
+}
+
+func newFlagSet(name string) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: clustering %s\n", commands[name].usage)
+		flags.PrintDefaults()
+	}
+	return flags
+}
+
+// pipelineFlags are the flags shared by the commands which score the input.
+type pipelineFlags struct {
+	cacheIn    string
+	threshold  int
+	workers    int
+	output     string
+	verbose    bool
+	lenient    bool
+	maxRuntime time.Duration
+	checkpoint string
+	interval   time.Duration
+	resume     bool
+	memory     memoryLimitFlag
+	metrics    string
+}
+
+// register adds the flags of the commands which score the requested STs with runScores.
+func (p *pipelineFlags) register(flags *flag.FlagSet) {
+	p.registerBasic(flags)
+	flags.BoolVar(&p.lenient, "lenient", false, "drop the STs whose profiles are missing or malformed rather than failing")
+	flags.StringVar(&p.checkpoint, "checkpoint", "", "save the scores to this file while they're being calculated")
+	flags.DurationVar(&p.interval, "checkpoint-every", CHECKPOINT_INTERVAL, "how often to save the checkpoint")
+	flags.BoolVar(&p.resume, "resume", false, "load the scores saved to the checkpoint and only calculate the rest")
+	flags.Var(&p.memory, "memory-limit", MEMORY_LIMIT_USAGE)
+}
+
+// registerBasic adds the flags which every command reading the input honours.
+func (p *pipelineFlags) registerBasic(flags *flag.FlagSet) {
+	flags.StringVar(&p.cacheIn, "cache-in", "", "read the cache from this file rather than from the input")
+	flags.IntVar(&p.threshold, "threshold", -1, "override the threshold given in the request")
+	flags.IntVar(&p.workers, "workers", 0, "number of scoring workers (default one more than the number of CPUs)")
+	flags.StringVar(&p.output, "o", "", "write the output to this file (default stdout)")
+	flags.BoolVar(&p.verbose, "v", false, "log progress to stderr")
+	flags.DurationVar(&p.maxRuntime, "max-runtime", 0, "stop with a CANCELLED error after this long, e.g. 30m (default no limit)")
+	flags.StringVar(&p.metrics, "metrics", "", METRICS_USAGE)
+}
+
+func (p *pipelineFlags) options() Options {
+	opts := Options{
+		CacheIn:            p.cacheIn,
+		Workers:            p.workers,
+		Lenient:            p.lenient,
+		MaxRuntime:         p.maxRuntime,
+		Checkpoint:         p.checkpoint,
+		CheckpointInterval: p.interval,
+		Resume:             p.resume,
+		MemoryLimit:        int64(p.memory),
+	}
+	if p.threshold >= 0 {
+		threshold := p.threshold
+		opts.Threshold = &threshold
+	}
+	return opts
+}
+
+// context is cancelled by SIGINT or SIGTERM or once the maximum runtime has passed.  The metrics
+// are served until it's cancelled.
+func (p *pipelineFlags) context() (context.Context, context.CancelFunc) {
+	stopMetrics := serveMetrics(p.metrics)
+	ctx, stop := signalContext()
+	ctx, cancel := p.options().withMaxRuntime(ctx)
+	return ctx, func() {
+		cancel()
+		stop()
+		stopMetrics()
+	}
+}
+
+func openInput(path string) (io.ReadCloser, error) {
+	if path == "" || path == "-" {
+		return io.NopCloser(bufio.NewReaderSize(os.Stdin, 16000000)), nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
+
+func createOutput(path string) (io.WriteCloser, error) {
+	if path == "" || path == "-" {
+		return nopWriteCloser{os.Stdout}, nil
+	}
+	return os.Create(path)
+}
+
+// backgroundProgress consumes the progress messages of a command which doesn't stream them with
+// its results.  stop ends the run, so that the metrics no longer count it as active, and waits for
+// its last message.
+func backgroundProgress(verbose bool) (progress chan ProgressEvent, stop func()) {
+	progressIn, progressOut := NewProgressWorker()
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		for msg := range progressOut {
+			if verbose {
+				log.Printf("%s: %d/%d (%.1f%%, %.0fs left)\n", msg.Message, msg.Done, msg.Total, msg.Progress, msg.ETA)
+			}
+		}
+	}()
+	return progressIn, func() {
+		progressIn <- ProgressEvent{EXIT, 0}
+		<-done
+	}
+}
+
+// fail logs the error and returns its exit code.
+func fail(err error) int {
+	log.Println(err)
+	return exitCode(err)
+}
+
+// parseFlags parses the flags and opens the input and output files.
+func parseFlags(flags *flag.FlagSet, args []string, output *string) (r io.ReadCloser, w io.WriteCloser, code int) {
+	if err := flags.Parse(args); err != nil {
+		return nil, nil, EXIT_USAGE
+	}
+	if flags.NArg() > 1 {
+		flags.Usage()
+		return nil, nil, EXIT_USAGE
+	}
+	var err error
+	if r, err = openInput(flags.Arg(0)); err != nil {
+		return nil, nil, fail(err)
+	}
+	if w, err = createOutput(*output); err != nil {
+		r.Close()
+		return nil, nil, fail(err)
+	}
+	return r, w, EXIT_OK
+}
+
+func runCluster(args []string) int {
+	var p pipelineFlags
+	flags := newFlagSet("cluster")
+	p.register(flags)
+	cacheOut := flags.String("cache-out", "", "write the clustering to this file so it can be used as a cache")
+	linkage := flags.String("linkage", "", "override the linkage given in the request: single, complete or average")
+	summaries := flags.Bool("summaries", false, "with -format json also write a summary of the clusters at each threshold")
+	format := flags.String("format", "json", "output format: json (the same documents as the default mode) or tsv (cluster of each ST at each threshold)")
+	progressSink := flags.String("progress", PROGRESS_STDOUT, "with -format json, "+PROGRESS_USAGE)
+	envelope := flags.Bool("envelope", false, "with -format json, "+ENVELOPE_USAGE)
+	r, w, code := parseFlags(flags, args, &p.output)
+	if code != EXIT_OK {
+		return code
+	}
+	defer r.Close()
+	defer w.Close()
+	ctx, cancel := p.context()
+	defer cancel()
+
+	opts := p.options()
+	opts.CacheOut = *cacheOut
+	opts.Linkage = *linkage
+	opts.Summaries = *summaries
+	opts.Progress = *progressSink
+	opts.Envelope = *envelope
+	switch *format {
+	case "json":
+		if _, _, _, err := _main(ctx, r, w, opts); err != nil {
+			return fail(err)
+		}
+		return EXIT_OK
+	case "tsv":
+	default:
+		return fail(fmt.Errorf("unknown format '%s'", *format))
+	}
+
+	progress, stopProgress := backgroundProgress(p.verbose)
+	defer stopProgress()
+	request, cache, _, scores, err := scoreInput(ctx, r, opts, progress)
+	if err != nil {
+		return fail(err)
+	}
+	clusters, merges, err := clusterScores(ctx, &scores, &cache, request.Linkage, progress)
+	if err != nil {
+		return fail(err)
+	}
+	if opts.CacheOut != "" {
+		cacheOutput := NewCacheOutput()
+		for c := range clusters.Format(ctx, request.Threshold, scores.scores, scores.STs) {
+			cacheOutput.Merge(c)
+		}
+		if merges != nil {
+			cacheOutput.Linkage = request.Linkage
+		}
+		if err = WriteCacheFile(opts.CacheOut, cacheOutput); err != nil {
+			return fail(err)
+		}
+	}
+	if err = writeClusterTable(w, scores.STs, clusters, request.Threshold); err != nil {
+		return fail(err)
+	}
+	return EXIT_OK
+}
+
+// writeClusterTable writes a row for each ST with the cluster it is in at each threshold.  Clusters
+// are named after the index of their last ST.
+func writeClusterTable(w io.Writer, STs []CgmlstSt, clusters Clusters, threshold int) error {
+	buf := bufio.NewWriter(w)
+	buf.WriteString("ST")
+	assignments := make([][]int, threshold+1)
+	for t := 0; t <= threshold; t++ {
+		fmt.Fprintf(buf, "\t%d", t)
+		assignments[t] = clusters.Get(t)
+	}
+	buf.WriteString("\n")
+	for i, st := range STs {
+		buf.WriteString(st)
+		for t := 0; t <= threshold; t++ {
+			buf.WriteString("\t")
+			buf.WriteString(strconv.Itoa(assignments[t][i]))
+		}
+		buf.WriteString("\n")
+	}
+	return buf.Flush()
+}
+
+func runScore(args []string) int {
+	var p pipelineFlags
+	flags := newFlagSet("score")
+	p.register(flags)
+	format := flags.String("format", "tsv", "output format: tsv (one pair per line) or json (edges document)")
+	r, w, code := parseFlags(flags, args, &p.output)
+	if code != EXIT_OK {
+		return code
+	}
+	defer r.Close()
+	defer w.Close()
+	ctx, cancel := p.context()
+	defer cancel()
+
+	progress, stopProgress := backgroundProgress(p.verbose)
+	defer stopProgress()
+	request, _, _, scores, err := scoreInput(ctx, r, p.options(), progress)
+	if err != nil {
+		return fail(err)
+	}
+
+	switch *format {
+	case "tsv":
+		buf := bufio.NewWriter(w)
+		buf.WriteString("ST_A\tST_B\tdistance\n")
+		scores.eachPair(request.Threshold, func(a, b, distance int) {
+			fmt.Fprintf(buf, "%s\t%s\t%d\n", scores.STs[a], scores.STs[b], distance)
+		})
+		err = buf.Flush()
+	case "json":
+		output := ClusterOutput{Edges: map[int][][2]int{}, Pi: []int{}, Lambda: []int{}, Sts: scores.STs, Threshold: request.Threshold}
+		for t := 0; t <= request.Threshold; t++ {
+			output.Edges[t] = [][2]int{}
+		}
+		scores.eachPair(request.Threshold, func(a, b, distance int) {
+			output.Edges[distance] = append(output.Edges[distance], [2]int{a, b})
+		})
+		err = json.NewEncoder(w).Encode(output)
+	default:
+		err = fmt.Errorf("unknown format '%s'", *format)
+	}
+	if err != nil {
+		return fail(err)
+	}
+	return EXIT_OK
+}
+
+// eachPair calls fn with the indexes of every pair of STs which are no more than threshold apart.
+func (s *ScoresStore) eachPair(threshold int, fn func(a, b, distance int)) {
+	idx := 0
+	for b := 1; b < len(s.STs); b++ {
+		for a := 0; a < b; a++ {
+			if distance := s.scores[idx]; distance <= threshold {
+				fn(a, b, distance)
+			}
+			idx++
+		}
+	}
+}
+
+func runTree(args []string) int {
+	var p pipelineFlags
+	flags := newFlagSet("tree")
+	p.register(flags)
+	linkage := flags.String("linkage", "", "override the linkage given in the request: single, complete or average")
+	format := flags.String("format", "newick", "output format: newick or json (list of merges)")
+	r, w, code := parseFlags(flags, args, &p.output)
+	if code != EXIT_OK {
+		return code
+	}
+	defer r.Close()
+	defer w.Close()
+	ctx, cancel := p.context()
+	defer cancel()
+
+	progress, stopProgress := backgroundProgress(p.verbose)
+	defer stopProgress()
+	opts := p.options()
+	opts.Linkage = *linkage
+	request, cache, _, scores, err := scoreInput(ctx, r, opts, progress)
+	if err != nil {
+		return fail(err)
+	}
+	clusters, merges, err := clusterScores(ctx, &scores, &cache, request.Linkage, progress)
+	if err != nil {
+		return fail(err)
+	}
+
+	if merges == nil {
+		merges = clusters.Dendrogram()
+	}
+	switch *format {
+	case "newick":
+		err = WriteNewick(w, merges, scores.STs)
+	case "json":
+		err = json.NewEncoder(w).Encode(struct {
+			STs    []CgmlstSt `json:"STs"`
+			Merges []Merge    `json:"merges"`
+		}{scores.STs, merges})
+	default:
+		err = fmt.Errorf("unknown format '%s'", *format)
+	}
+	if err != nil {
+		return fail(err)
+	}
+	return EXIT_OK
+}
+
+// CacheReport summarises a cache
+type CacheReport struct {
+	STs       int         `json:"STs"`
+	Threshold int         `json:"threshold"`
+	Edges     map[int]int `json:"edges"`    // number of edges at each distance
+	Clusters  map[int]int `json:"clusters"` // number of clusters at each threshold up to the cache's threshold
+	Problems  []string    `json:"problems"`
+}
+
+// Inspect checks that the cache is consistent and counts its edges and clusters.
+func (c *Cache) Inspect() CacheReport {
+	report := CacheReport{
+		STs:       len(c.Sts),
+		Threshold: c.Threshold,
+		Edges:     map[int]int{},
+		Clusters:  map[int]int{},
+		Problems:  c.problems(),
+	}
+	for distance, pairs := range c.Edges {
+		report.Edges[distance] = len(pairs)
+		if distance > c.Threshold {
+			report.Problems = append(report.Problems, fmt.Sprintf("found edges at %d which is above the threshold", distance))
+		}
+	}
+
+	if c.validPointers() {
+		clusters := Clusters{c.Pi, c.Lambda, len(c.Sts)}
+		for t := 0; t <= c.Threshold; t++ {
+			report.Clusters[t] = countClusters(clusters.Get(t))
+		}
+	}
+	sort.Strings(report.Problems)
+	return report
+}
+
+// Validate returns an INVALID_CACHE error if the cache can't be used: it doesn't have a pi and
+// lambda for each ST, an ST is in it more than once or a pointer or an edge refers to a missing ST.
+// Edges above the threshold are ignored rather than rejected.
+func (c *Cache) Validate() error {
+	if problems := c.problems(); len(problems) > 0 {
+		sort.Strings(problems)
+		if len(problems) > 1 {
+			return newPipelineError(INVALID_CACHE, "", "the cache isn't consistent: %s and %d other problems", problems[0], len(problems)-1)
+		}
+		return newPipelineError(INVALID_CACHE, "", "the cache isn't consistent: %s", problems[0])
+	}
+	return nil
+}
+
+// problems are the inconsistencies which would stop the cache being used.
+func (c *Cache) problems() []string {
+	problems := []string{}
+	nItems := len(c.Sts)
+	if len(c.Pi) != nItems || len(c.Lambda) != nItems {
+		problems = append(problems, fmt.Sprintf("expected %d pi and lambda values, got %d and %d", nItems, len(c.Pi), len(c.Lambda)))
+	}
+
+	seen := make(map[CgmlstSt]bool)
+	for _, st := range c.Sts {
+		if seen[st] {
+			problems = append(problems, fmt.Sprintf("ST '%s' is in the cache more than once", st))
+		}
+		seen[st] = true
+	}
+
+	for i, p := range c.Pi {
+		if !validPointer(c.Pi, i) {
+			problems = append(problems, fmt.Sprintf("pi[%d] is %d", i, p))
+		}
+	}
+
+	for distance, pairs := range c.Edges {
+		for _, pair := range pairs {
+			if pair[0] < 0 || pair[1] < 0 || pair[0] >= nItems || pair[1] >= nItems {
+				problems = append(problems, fmt.Sprintf("edge %v at %d refers to a missing ST", pair, distance))
+			}
+		}
+	}
+	return problems
+}
+
+// validPointer is whether pi[i] points to a later item, or to itself for the last item.
+func validPointer(pi []int, i int) bool {
+	p := pi[i]
+	return p >= i && p < len(pi) && (p != i || i == len(pi)-1)
+}
+
+// validPointers is whether the pointer representation can be turned into clusters.
+func (c *Cache) validPointers() bool {
+	if len(c.Pi) != len(c.Sts) || len(c.Lambda) != len(c.Sts) {
+		return false
+	}
+	for i := range c.Pi {
+		if !validPointer(c.Pi, i) {
+			return false
+		}
+	}
+	return true
+}
+
+func runCache(args []string) int {
+	if len(args) == 0 || args[0] != "inspect" {
+		commands["cache"].runUsage()
+		return EXIT_USAGE
+	}
+	flags := newFlagSet("cache")
+	output := flags.String("o", "", "write the output to this file (default stdout)")
+	r, w, code := parseFlags(flags, args[1:], output)
+	if code != EXIT_OK {
+		return code
+	}
+	defer r.Close()
+	defer w.Close()
+
+	var cache Cache
+	if err := json.NewDecoder(r).Decode(&cache); err != nil {
+		return fail(err)
+	}
+	report := cache.Inspect()
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		return fail(err)
+	}
+	if len(report.Problems) > 0 {
+		return EXIT_FAILURE
+	}
+	return EXIT_OK
+}
+
+func (c command) runUsage() {
+	fmt.Fprintf(os.Stderr, "Usage: clustering %s\n", c.usage)
+}
+
+// ValidationReport describes the problems found in the input
+type ValidationReport struct {
+	Requested     int         `json:"requested"`
+	Duplicates    []CgmlstSt  `json:"duplicates"` // STs which are in the request more than once
+	Missing       []CgmlstSt  `json:"missing"`    // requested STs without a profile
+	CacheReusable bool        `json:"cacheReusable"`
+	Cache         CacheReport `json:"cache"`
+	Valid         bool        `json:"valid"`
+}
+
+func runValidate(args []string) int {
+	flags := newFlagSet("validate")
+	output := flags.String("o", "", "write the output to this file (default stdout)")
+	cacheIn := flags.String("cache-in", "", "read the cache from this file rather than from the input")
+	r, w, code := parseFlags(flags, args, output)
+	if code != EXIT_OK {
+		return code
+	}
+	defer r.Close()
+	defer w.Close()
+	ctx, stop := signalContext()
+	defer stop()
+
+	progress, stopProgress := backgroundProgress(false)
+	defer stopProgress()
+	request, cache, indexer, err := parse(ctx, r, *cacheIn, progress)
+	if err != nil {
+		return fail(err)
+	}
+	index := indexer.index
+
+	report := ValidationReport{
+		Requested:  len(request.STs),
+		Duplicates: []CgmlstSt{},
+		Missing:    index.Missing(),
+		Cache:      cache.Inspect(),
+	}
+	seen := make(map[CgmlstSt]bool)
+	for _, st := range request.STs {
+		if seen[st] {
+			report.Duplicates = append(report.Duplicates, st)
+		}
+		seen[st] = true
+	}
+	report.CacheReusable, _, _, _ = sortSts(request.STs, &cache, index)
+	report.CacheReusable = report.CacheReusable && len(report.Cache.Problems) == 0
+	report.Valid = len(report.Missing) == 0 && len(report.Cache.Problems) == 0
+
+	if err = json.NewEncoder(w).Encode(report); err != nil {
+		return fail(err)
+	}
+	if !report.Valid {
+		return EXIT_FAILURE
+	}
+	return EXIT_OK
+}
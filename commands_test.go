@@ -0,0 +1,85 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeInput(t *testing.T, path string, input io.Reader) string {
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err = io.Copy(f, input); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestCommandFlags(t *testing.T) {
+	dir := t.TempDir()
+	input := writeInput(t, filepath.Join(dir, "input.json"), fakeInput(`{"STs": ["A", "B", "C", "D", "E"], "Threshold": 3}`, "{}", fakeProfiles))
+	cachePath := filepath.Join(dir, "cache.json")
+	if code := runCluster([]string{"-cache-out", cachePath, "-o", filepath.Join(dir, "first.json"), input}); code != EXIT_OK {
+		t.Fatalf("Expected the cache to be written, got exit status %d", code)
+	}
+	appendInput := writeInput(t, filepath.Join(dir, "append.json"), fakeInput(`{"STs": ["A", "B", "C", "D", "E"], "Threshold": 3}`, "", fakeProfiles))
+	out := filepath.Join(dir, "out")
+
+	tests := []struct {
+		command string
+		args    []string
+		code    int
+	}{
+		{"cluster", []string{"-o", out, input}, EXIT_OK},
+		{"cluster", []string{"-lenient", "-checkpoint", filepath.Join(dir, "checkpoint"), "-resume", "-memory-limit", "none", "-o", out, input}, EXIT_OK},
+		{"score", []string{"-threshold", "2", "-o", out, input}, EXIT_OK},
+		{"tree", []string{"-linkage", "average", "-o", out, input}, EXIT_OK},
+		{"changes", []string{"-o", out, input}, EXIT_OK},
+		{"consensus", []string{"-o", out, input}, EXIT_OK},
+		{"diff", []string{"-a", "A", "-b", "B", "-o", out, input}, EXIT_OK},
+		{"matrix", []string{"-o", out, input}, EXIT_OK},
+		{"mst", []string{"-o", out, input}, EXIT_OK},
+		{"nj", []string{"-o", out, input}, EXIT_OK},
+		{"recommend", []string{"-o", out, input}, EXIT_OK},
+		{"query", []string{"-st", "A", "-o", out, input}, EXIT_OK},
+		{"cache", []string{"inspect", "-o", out, cachePath}, EXIT_OK},
+		{"validate", []string{"-o", out, input}, EXIT_OK},
+		{"append", []string{"-cache-in", cachePath, "-o", out, appendInput}, EXIT_OK},
+		{"help", nil, EXIT_OK},
+		// append only scores the new STs so it doesn't take the flags which change how STs are scored
+		{"append", []string{"-resume", "-cache-in", cachePath, "-o", out, appendInput}, EXIT_USAGE},
+		{"append", []string{"-lenient", "-cache-in", cachePath, "-o", out, appendInput}, EXIT_USAGE},
+		{"append", []string{"-memory-limit", "1G", "-cache-in", cachePath, "-o", out, appendInput}, EXIT_USAGE},
+		// query only compares one profile so it doesn't take the scoring flags
+		{"query", []string{"-workers", "2", "-st", "A", "-o", out, input}, EXIT_USAGE},
+		// serve doesn't return until it's stopped
+		{"serve", []string{"-listen"}, EXIT_USAGE},
+	}
+
+	tested := make(map[string]bool)
+	for _, test := range tests {
+		tested[test.command] = true
+		if code := commands[test.command].run(test.args); code != test.code {
+			t.Errorf("Expected %s %v to exit with %d, got %d", test.command, test.args, test.code, code)
+		}
+	}
+	for name, command := range commands {
+		if !tested[name] {
+			t.Errorf("Expected a test of the %s command", name)
+		}
+		args := []string{"-no-such-flag"}
+		if name == "cache" {
+			args = []string{"inspect", "-no-such-flag"}
+		}
+		if name == "help" {
+			continue
+		}
+		if code := command.run(args); code != EXIT_USAGE {
+			t.Errorf("Expected %s to reject an unknown flag, got %d", name, code)
+		}
+	}
+}
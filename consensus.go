@@ -0,0 +1,171 @@
+package main
+
+import (
+	"github.com/goccy/go-json"
+	"log"
+	"sort"
+)
+
+// ConsensusProfile is the representative profile of a cluster.  Matches holds the majority allele at
+// each locus, like the Matches of a Profile, and is empty where there isn't one.  A locus is missing
+// if fewer than half of the members call it and ambiguous if no allele is called by more than half
+// of the members which call it.
+type ConsensusProfile struct {
+	Threshold int        `json:"threshold"`
+	Cluster   CgmlstSt   `json:"cluster"` // the last ST in the cluster, as in the other outputs
+	STs       []CgmlstSt `json:"STs"`
+	Matches   []string   `json:"Matches"`
+	Ambiguous []int      `json:"ambiguous"`
+	Missing   []int      `json:"missing"`
+}
+
+// Consensus finds the majority allele at each of the loci from the alleles of the members of a
+// cluster as returned by Indexer.Alleles.
+func Consensus(members []map[int]string, nLoci int) (matches []string, ambiguous []int, missing []int) {
+	matches = make([]string, nLoci)
+	ambiguous = make([]int, 0)
+	missing = make([]int, 0)
+	for locus := 0; locus < nLoci; locus++ {
+		counts := make(map[string]int)
+		called := 0
+		for _, alleles := range members {
+			if allele, found := alleles[locus]; found {
+				counts[allele]++
+				called++
+			}
+		}
+		if 2*called < len(members) {
+			missing = append(missing, locus)
+		}
+		if called == 0 {
+			continue
+		}
+
+		// Break ties by allele so that the output doesn't depend on the order of the map
+		alleles := make([]string, 0, len(counts))
+		for allele := range counts {
+			alleles = append(alleles, allele)
+		}
+		sort.Strings(alleles)
+		best := alleles[0]
+		for _, allele := range alleles[1:] {
+			if counts[allele] > counts[best] {
+				best = allele
+			}
+		}
+		if 2*counts[best] <= called {
+			ambiguous = append(ambiguous, locus)
+		}
+		matches[locus] = best
+	}
+	return
+}
+
+// ClusterConsensus builds the consensus profile of each cluster at each of the thresholds.
+func ClusterConsensus(indexer *Indexer, clusters Clusters, STs []CgmlstSt, thresholds []int) ([]ConsensusProfile, error) {
+	alleles := make([]map[int]string, len(STs))
+	nLoci := 0
+	for i, st := range STs {
+		var err error
+		if alleles[i], err = indexer.Alleles(st); err != nil {
+			return nil, err
+		}
+		for locus := range alleles[i] {
+			if locus >= nLoci {
+				nLoci = locus + 1
+			}
+		}
+	}
+
+	profiles := make([]ConsensusProfile, 0)
+	for _, t := range thresholds {
+		ids := clusters.Get(t)
+		members := make(map[int][]int)
+		order := make([]int, 0)
+		for i, id := range ids {
+			if _, found := members[id]; !found {
+				order = append(order, id)
+			}
+			members[id] = append(members[id], i)
+		}
+		for _, id := range order {
+			profile := ConsensusProfile{Threshold: t, Cluster: STs[id], STs: make([]CgmlstSt, 0, len(members[id]))}
+			memberAlleles := make([]map[int]string, 0, len(members[id]))
+			for _, i := range members[id] {
+				profile.STs = append(profile.STs, STs[i])
+				memberAlleles = append(memberAlleles, alleles[i])
+			}
+			profile.Matches, profile.Ambiguous, profile.Missing = Consensus(memberAlleles, nLoci)
+			profiles = append(profiles, profile)
+		}
+	}
+	return profiles, nil
+}
+
+// consensusThresholds reads the thresholds to cut the clusters at.  The distances are only known up
+// to the request's threshold, and up to the threshold of the cache if one is reused, so the clusters
+// can't be cut any higher.
+func consensusThresholds(value string, request Request, cache *Cache) ([]int, error) {
+	known := request.Threshold
+	if len(cache.Sts) > 0 && cache.Threshold < known {
+		if value == "" {
+			log.Printf("The cache only goes up to %d so the clusters are cut up to that threshold\n", cache.Threshold)
+		}
+		known = cache.Threshold
+	}
+	thresholds, err := parseThresholds(value, known)
+	if err != nil {
+		return nil, err
+	}
+	return thresholds, checkThresholds(thresholds, known)
+}
+
+func runConsensus(args []string) int {
+	var p pipelineFlags
+	flags := newFlagSet("consensus")
+	p.register(flags)
+	thresholdList := flags.String("thresholds", "", "comma separated thresholds to cut the clusters at (default 0 to the request's or the cache's threshold, whichever is lower)")
+	r, w, code := parseFlags(flags, args, &p.output)
+	if code != EXIT_OK {
+		return code
+	}
+	defer r.Close()
+	defer w.Close()
+	ctx, cancel := p.context()
+	defer cancel()
+
+	progress, stopProgress := backgroundProgress(p.verbose)
+	defer stopProgress()
+	opts := p.options()
+	request, cache, indexer, err := parseChecked(ctx, r, opts.CacheIn, planRequest(opts, false), progress)
+	if err != nil {
+		return fail(err)
+	}
+	opts.apply(&request)
+
+	thresholds, err := consensusThresholds(*thresholdList, request, &cache)
+	if err != nil {
+		return fail(err)
+	}
+
+	scores, err := runScores(ctx, request, &cache, indexer.index, opts, progress)
+	if err != nil {
+		return fail(err)
+	}
+	clusters, _, err := clusterScores(ctx, &scores, &cache, request.Linkage, progress)
+	if err != nil {
+		return fail(err)
+	}
+	profiles, err := ClusterConsensus(indexer, clusters, scores.STs, thresholds)
+	if err != nil {
+		return fail(err)
+	}
+
+	encoder := json.NewEncoder(w)
+	for _, profile := range profiles {
+		if err = encoder.Encode(profile); err != nil {
+			return fail(err)
+		}
+	}
+	return EXIT_OK
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestConsensus(t *testing.T) {
+	members := []map[int]string{
+		{0: "1", 1: "1", 2: "1"},
+		{0: "1", 1: "2", 3: "4"},
+		{0: "2", 1: "3"},
+		{0: "1", 1: "1"},
+	}
+	matches, ambiguous, missing := Consensus(members, 5)
+	if expected := []string{"1", "1", "1", "4", ""}; !reflect.DeepEqual(matches, expected) {
+		t.Fatalf("Expected %v, got %v", expected, matches)
+	}
+	if expected := []int{1}; !reflect.DeepEqual(ambiguous, expected) {
+		t.Fatalf("Expected %v to be ambiguous, got %v", expected, ambiguous)
+	}
+	if expected := []int{2, 3, 4}; !reflect.DeepEqual(missing, expected) {
+		t.Fatalf("Expected %v to be missing, got %v", expected, missing)
+	}
+}
+
+func TestClusterConsensus(t *testing.T) {
+	progress, stopProgress := backgroundProgress(false)
+	defer stopProgress()
+	request, _, indexer, err := parse(context.Background(), fakeInput(`{"STs": ["A", "B", "C", "D", "E"], "Threshold": 1}`, "{}", fakeProfiles), "", progress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	scores, err := runScores(context.Background(), request, NewCache(), indexer.index, Options{}, progress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clusters, _, err := clusterScores(context.Background(), &scores, NewCache(), request.Linkage, progress)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	profiles, err := ClusterConsensus(indexer, clusters, scores.STs, []int{1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A and B are 1 apart, as are C and E
+	if len(profiles) != 3 {
+		t.Fatalf("Expected 3 clusters, got %v", profiles)
+	}
+	expected := ConsensusProfile{1, "B", []CgmlstSt{"A", "B"}, []string{"1", "1", "1", "1", "1", "1"}, []int{5}, []int{}}
+	if !reflect.DeepEqual(profiles[0], expected) {
+		t.Fatalf("Expected %v, got %v", expected, profiles[0])
+	}
+}
+
+func TestConsensusThresholds(t *testing.T) {
+	request := Request{Threshold: 3}
+	thresholds, err := consensusThresholds("", request, NewCache())
+	if err != nil || !reflect.DeepEqual(thresholds, []int{0, 1, 2, 3}) {
+		t.Fatalf("Expected the request's thresholds, got %v %v", thresholds, err)
+	}
+
+	// The cache only knows the distances up to 1
+	cache := Cache{Sts: []CgmlstSt{"A", "B"}, Pi: []int{1, 1}, Lambda: []int{1, ALMOST_INF}, Threshold: 1}
+	if thresholds, err = consensusThresholds("", request, &cache); err != nil || !reflect.DeepEqual(thresholds, []int{0, 1}) {
+		t.Fatalf("Expected the cache's thresholds, got %v %v", thresholds, err)
+	}
+	_, err = consensusThresholds("0,2", request, &cache)
+	if pipelineErr, ok := err.(*PipelineError); !ok || pipelineErr.Code != INVALID_INPUT {
+		t.Fatalf("Expected an INVALID_INPUT error, got %v", err)
+	}
+
+	_, err = consensusThresholds("4", request, NewCache())
+	if pipelineErr, ok := err.(*PipelineError); !ok || pipelineErr.Code != INVALID_INPUT {
+		t.Fatalf("Expected an INVALID_INPUT error above the request's threshold, got %v", err)
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Merge is one step of a dendrogram.  Nodes below the number of items are the items themselves,
+// node `nItems + k` is the cluster created by the k-th merge (as in scipy's linkage matrix).
+type Merge struct {
+	A        int     `json:"a"`
+	B        int     `json:"b"`
+	Distance float64 `json:"distance"`
+	Size     int     `json:"size"`
+}
+
+// Dendrogram converts the pointer representation (pi and lambda) into a list of merges ordered by
+// distance.  Clusters which never join, because they're further apart than the cache's threshold or
+// don't share enough loci, are left as separate roots.
+func (c Clusters) Dendrogram() []Merge {
+	order := make([]int, 0, c.nItems)
+	for i := 0; i < c.nItems; i++ {
+		if c.pi[i] != i && c.lambda[i] < ALMOST_INF {
+			order = append(order, i)
+		}
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		return c.lambda[order[a]] < c.lambda[order[b]]
+	})
+
+	parent := make([]int, c.nItems) // union-find over the items
+	node := make([]int, c.nItems)   // the dendrogram node of each union-find root
+	size := make([]int, c.nItems)
+	for i := range parent {
+		parent[i] = i
+		node[i] = i
+		size[i] = 1
+	}
+	find := func(i int) int {
+		for parent[i] != i {
+			parent[i] = parent[parent[i]]
+			i = parent[i]
+		}
+		return i
+	}
+
+	merges := make([]Merge, 0, len(order))
+	for _, i := range order {
+		a, b := find(i), find(c.pi[i])
+		if a == b {
+			continue
+		}
+		merges = append(merges, Merge{node[a], node[b], float64(c.lambda[i]), size[a] + size[b]})
+		parent[a] = b
+		size[b] += size[a]
+		node[b] = c.nItems + len(merges) - 1
+	}
+	return merges
+}
+
+func newickLabel(label string) string {
+	if strings.ContainsAny(label, " \t\n'()[]:;,") {
+		return "'" + strings.ReplaceAll(label, "'", "''") + "'"
+	}
+	return label
+}
+
+// WriteNewick writes the dendrogram as a Newick tree.  Each merge sits at half of its distance so
+// that the path between two leaves has the length of the distance at which they were clustered.
+// If there is more than one root they are joined by a multifurcating root.
+func WriteNewick(w io.Writer, merges []Merge, labels []CgmlstSt) error {
+	nItems := len(labels)
+	buf := bufio.NewWriter(w)
+
+	height := func(n int) float64 {
+		if n < nItems {
+			return 0
+		}
+		return merges[n-nItems].Distance / 2
+	}
+	children := func(n int) []int {
+		if n < nItems {
+			return nil
+		}
+		m := merges[n-nItems]
+		return []int{m.A, m.B}
+	}
+
+	isChild := make([]bool, nItems+len(merges))
+	for _, m := range merges {
+		isChild[m.A] = true
+		isChild[m.B] = true
+	}
+	roots := make([]int, 0, 1)
+	for n, child := range isChild {
+		if !child {
+			roots = append(roots, n)
+		}
+	}
+
+	type frame struct {
+		node     int
+		children []int
+		next     int
+	}
+	writeTree := func(root int) {
+		stack := []frame{{root, children(root), 0}}
+		for len(stack) > 0 {
+			top := &stack[len(stack)-1]
+			if len(top.children) == 0 {
+				buf.WriteString(newickLabel(labels[top.node]))
+			} else if top.next < len(top.children) {
+				if top.next == 0 {
+					buf.WriteByte('(')
+				} else {
+					buf.WriteByte(',')
+				}
+				child := top.children[top.next]
+				top.next++
+				stack = append(stack, frame{child, children(child), 0})
+				continue
+			} else {
+				buf.WriteByte(')')
+			}
+			stack = stack[:len(stack)-1]
+			if len(stack) > 0 {
+				parent := stack[len(stack)-1].node
+				buf.WriteByte(':')
+				buf.WriteString(strconv.FormatFloat(height(parent)-height(top.node), 'f', -1, 64))
+			}
+		}
+	}
+
+	if len(roots) == 1 {
+		writeTree(roots[0])
+	} else if len(roots) > 1 {
+		buf.WriteByte('(')
+		for i, root := range roots {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			writeTree(root)
+		}
+		buf.WriteByte(')')
+	}
+	buf.WriteString(";\n")
+	return buf.Flush()
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestDendrogram(t *testing.T) {
+	// A-1-B-2-C-1-E
+	//         |
+	//         3-D
+	distances := []int{
+		1,
+		3, 2,
+		5, 4, 3,
+		3, 3, 1, 4,
+	}
+	clusters, err := ClusterFromScratch(distances, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	merges := clusters.Dendrogram()
+	expected := []Merge{
+		{0, 1, 1, 2},
+		{2, 4, 1, 2},
+		{5, 6, 2, 4},
+		{3, 7, 3, 5},
+	}
+	if !reflect.DeepEqual(merges, expected) {
+		t.Fatalf("Expected %v, got %v", expected, merges)
+	}
+
+	var newick bytes.Buffer
+	if err := WriteNewick(&newick, merges, []CgmlstSt{"A", "B", "C", "D", "E:1"}); err != nil {
+		t.Fatal(err)
+	}
+	expectedNewick := "(D:1.5,((A:0.5,B:0.5):0.5,(C:0.5,'E:1':0.5):0.5):0.5);\n"
+	if newick.String() != expectedNewick {
+		t.Fatalf("Expected %s, got %s", expectedNewick, newick.String())
+	}
+}
+
+func TestNewickWithSeveralRoots(t *testing.T) {
+	var newick bytes.Buffer
+	if err := WriteNewick(&newick, []Merge{{0, 2, 2, 2}}, []CgmlstSt{"A", "B", "C"}); err != nil {
+		t.Fatal(err)
+	}
+	if expected := "(B,(A:1,C:1));\n"; newick.String() != expected {
+		t.Fatalf("Expected %s, got %s", expected, newick.String())
+	}
+}
+
+func TestDendrogramWithoutJoining(t *testing.T) {
+	// C is further from A and B than the cache's threshold so it never joins them
+	clusters, err := ClusterFromScratch([]int{1, ALMOST_INF, ALMOST_INF}, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if merges, expected := clusters.Dendrogram(), []Merge{{0, 1, 1, 2}}; !reflect.DeepEqual(merges, expected) {
+		t.Fatalf("Expected %v, got %v", expected, merges)
+	}
+}
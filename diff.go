@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/goccy/go-json"
+	"sort"
+)
+
+// LocusDiff gives the alleles of two STs at a locus.  The allele is empty if the locus is missing.
+type LocusDiff struct {
+	Locus int    `json:"locus"`
+	A     string `json:"a"`
+	B     string `json:"b"`
+}
+
+// ProfileDiff lists the loci which differ between two STs.  Loci are given by their position in
+// the profiles.  The distance is the number of loci with different alleles, as Comparer counts it.
+type ProfileDiff struct {
+	A         CgmlstSt    `json:"a"`
+	B         CgmlstSt    `json:"b"`
+	Distance  int         `json:"distance"`
+	Different []LocusDiff `json:"different"`
+	MissingA  []LocusDiff `json:"missingA"` // called in B but not in A
+	MissingB  []LocusDiff `json:"missingB"` // called in A but not in B
+}
+
+// DiffAlleles compares the alleles of two STs as returned by Indexer.Alleles.
+func DiffAlleles(stA CgmlstSt, a map[int]string, stB CgmlstSt, b map[int]string) ProfileDiff {
+	diff := ProfileDiff{A: stA, B: stB, Different: []LocusDiff{}, MissingA: []LocusDiff{}, MissingB: []LocusDiff{}}
+	for locus, alleleA := range a {
+		if alleleB, found := b[locus]; !found {
+			diff.MissingB = append(diff.MissingB, LocusDiff{locus, alleleA, ""})
+		} else if alleleA != alleleB {
+			diff.Different = append(diff.Different, LocusDiff{locus, alleleA, alleleB})
+		}
+	}
+	for locus, alleleB := range b {
+		if _, found := a[locus]; !found {
+			diff.MissingA = append(diff.MissingA, LocusDiff{locus, "", alleleB})
+		}
+	}
+	for _, loci := range [][]LocusDiff{diff.Different, diff.MissingA, diff.MissingB} {
+		sort.Slice(loci, func(i, j int) bool { return loci[i].Locus < loci[j].Locus })
+	}
+	diff.Distance = len(diff.Different)
+	return diff
+}
+
+// differ looks up the alleles of each ST once.
+type differ struct {
+	indexer *Indexer
+	alleles map[CgmlstSt]map[int]string
+}
+
+func (d *differ) diff(stA CgmlstSt, stB CgmlstSt) (ProfileDiff, error) {
+	for _, st := range []CgmlstSt{stA, stB} {
+		if _, found := d.alleles[st]; !found {
+			alleles, err := d.indexer.Alleles(st)
+			if err != nil {
+				return ProfileDiff{}, err
+			}
+			d.alleles[st] = alleles
+		}
+	}
+	return DiffAlleles(stA, d.alleles[stA], stB, d.alleles[stB]), nil
+}
+
+// writeDiffTable writes a row for each locus which differs or is missing in one of the STs.
+func writeDiffTable(buf *bufio.Writer, diff ProfileDiff) {
+	for _, rows := range []struct {
+		kind string
+		loci []LocusDiff
+	}{{"different", diff.Different}, {"missing_a", diff.MissingA}, {"missing_b", diff.MissingB}} {
+		for _, l := range rows.loci {
+			fmt.Fprintf(buf, "%s\t%s\t%d\t%s\t%s\t%s\n", diff.A, diff.B, l.Locus, rows.kind, l.A, l.B)
+		}
+	}
+}
+
+func runDiff(args []string) int {
+	var p pipelineFlags
+	flags := newFlagSet("diff")
+	p.register(flags)
+	stA := flags.String("a", "", "the first ST")
+	stB := flags.String("b", "", "the second ST")
+	format := flags.String("format", "tsv", "output format: tsv (one locus per line) or json (one document per pair)")
+	r, w, code := parseFlags(flags, args, &p.output)
+	if code != EXIT_OK {
+		return code
+	}
+	defer r.Close()
+	defer w.Close()
+	ctx, cancel := p.context()
+	defer cancel()
+	if (*stA == "") != (*stB == "") {
+		flags.Usage()
+		return EXIT_USAGE
+	}
+	if *format != "tsv" && *format != "json" {
+		return fail(fmt.Errorf("unknown format '%s'", *format))
+	}
+
+	progress, stopProgress := backgroundProgress(p.verbose)
+	defer stopProgress()
+	opts := p.options()
+	request, cache, indexer, err := parse(ctx, r, opts.CacheIn, progress)
+	if err != nil {
+		return fail(err)
+	}
+	opts.apply(&request)
+
+	// Without -a and -b every pair of STs up to the threshold is compared
+	pairs := [][2]CgmlstSt{{*stA, *stB}}
+	if *stA == "" {
+		scores, err := runScores(ctx, request, &cache, indexer.index, opts, progress)
+		if err != nil {
+			return fail(err)
+		}
+		pairs = pairs[:0]
+		scores.eachPair(request.Threshold, func(a, b, distance int) {
+			pairs = append(pairs, [2]CgmlstSt{scores.STs[a], scores.STs[b]})
+		})
+	}
+
+	d := differ{indexer, make(map[CgmlstSt]map[int]string)}
+	buf := bufio.NewWriter(w)
+	encoder := json.NewEncoder(buf)
+	if *format == "tsv" {
+		buf.WriteString("ST_A\tST_B\tlocus\tdifference\tallele_A\tallele_B\n")
+	}
+	for _, pair := range pairs {
+		diff, err := d.diff(pair[0], pair[1])
+		if err != nil {
+			return fail(err)
+		}
+		if *format == "json" {
+			err = encoder.Encode(diff)
+		} else {
+			writeDiffTable(buf, diff)
+		}
+		if err != nil {
+			return fail(err)
+		}
+	}
+	if err = buf.Flush(); err != nil {
+		return fail(err)
+	}
+	return EXIT_OK
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestDiff(t *testing.T) {
+	profiles := map[CgmlstSt][]string{
+		"A": {"1", "1", "1", "1", ""},
+		"B": {"1", "2", "", "1", "3"},
+	}
+	progress, stopProgress := backgroundProgress(false)
+	defer stopProgress()
+	_, _, indexer, err := parse(context.Background(), fakeInput(`{"STs": ["A", "B"], "Threshold": 1}`, "{}", profiles), "", progress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := differ{indexer, make(map[CgmlstSt]map[int]string)}
+	diff, err := d.diff("A", "B")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := ProfileDiff{
+		A:         "A",
+		B:         "B",
+		Distance:  1,
+		Different: []LocusDiff{{1, "1", "2"}},
+		MissingA:  []LocusDiff{{4, "", "3"}},
+		MissingB:  []LocusDiff{{2, "1", ""}},
+	}
+	if !reflect.DeepEqual(diff, expected) {
+		t.Fatalf("Expected %v, got %v", expected, diff)
+	}
+	if diff.Distance != newComparer(*indexer.index).compare(0, 1) {
+		t.Fatal("Expected the same distance as the comparer")
+	}
+
+	if _, err = d.diff("A", "C"); err == nil {
+		t.Fatal("Expected an error for an ST which hasn't been indexed")
+	}
+}
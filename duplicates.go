@@ -0,0 +1,180 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Policies for STs with more than one profile
+const (
+	DUPLICATES_FIRST    = "first"    // keep the first profile (the default)
+	DUPLICATES_STRICT   = "strict"   // fail if the profiles conflict
+	DUPLICATES_MAJORITY = "majority" // call the allele seen most often at each locus
+)
+
+// LocusConflict gives the allele of each profile of an ST at a locus where they disagree, in the
+// order the profiles were read ("" if the locus isn't called), and the allele which was kept.
+type LocusConflict struct {
+	Locus   int      `json:"locus"`
+	Alleles []string `json:"alleles"`
+	Kept    string   `json:"kept"`
+}
+
+// ProfileConflict lists the loci where the profiles of an ST disagree.
+type ProfileConflict struct {
+	ST       CgmlstSt        `json:"ST"`
+	Profiles int             `json:"profiles"`
+	Loci     []LocusConflict `json:"loci"`
+}
+
+// DuplicateProfiles is the output document listing the STs whose profiles conflict.
+type DuplicateProfiles struct {
+	Policy    string            `json:"duplicates"`
+	Conflicts []ProfileConflict `json:"conflicts"`
+}
+
+func normaliseDuplicates(policy string) (string, error) {
+	switch strings.ToLower(policy) {
+	case "", DUPLICATES_FIRST:
+		return DUPLICATES_FIRST, nil
+	case DUPLICATES_STRICT:
+		return DUPLICATES_STRICT, nil
+	case DUPLICATES_MAJORITY:
+		return DUPLICATES_MAJORITY, nil
+	}
+	return "", newPipelineError(INVALID_INPUT, "", "unknown duplicates policy '%s', expected first, strict or majority", policy)
+}
+
+// CheckDuplicates keeps every profile of the STs which are indexed more than once so that they can
+// be compared by ResolveDuplicates.
+func (i *Indexer) CheckDuplicates() {
+	i.submissions = make(map[CgmlstSt][]map[int]string)
+}
+
+// addSubmission records another profile of an ST which has already been indexed.
+func (i *Indexer) addSubmission(profile *Profile) {
+	if i.submissions == nil {
+		return
+	}
+	if _, found := i.submissions[profile.ST]; !found {
+		first, err := i.Alleles(profile.ST)
+		if err != nil {
+			return
+		}
+		i.submissions[profile.ST] = []map[int]string{first}
+	}
+	alleles := make(map[int]string, len(profile.Matches))
+	for locus, allele := range profile.Matches {
+		if allele != "" {
+			alleles[locus] = allele
+		}
+	}
+	i.submissions[profile.ST] = append(i.submissions[profile.ST], alleles)
+}
+
+// compareSubmissions finds the loci where the profiles disagree and the majority allele at each of
+// them.  Ties go to the allele of the earliest profile.
+func compareSubmissions(submissions []map[int]string) []LocusConflict {
+	loci := make(map[int]bool)
+	for _, alleles := range submissions {
+		for locus := range alleles {
+			loci[locus] = true
+		}
+	}
+	order := make([]int, 0, len(loci))
+	for locus := range loci {
+		order = append(order, locus)
+	}
+	sort.Ints(order)
+
+	conflicts := make([]LocusConflict, 0)
+	for _, locus := range order {
+		conflict := LocusConflict{Locus: locus, Alleles: make([]string, len(submissions))}
+		counts := make(map[string]int)
+		for n, alleles := range submissions {
+			allele := alleles[locus]
+			conflict.Alleles[n] = allele
+			if allele == "" {
+				continue
+			}
+			counts[allele]++
+			if counts[allele] > counts[conflict.Kept] {
+				conflict.Kept = allele
+			}
+		}
+		if len(counts) > 1 {
+			conflicts = append(conflicts, conflict)
+		}
+	}
+	return conflicts
+}
+
+// ResolveDuplicates compares the profiles of each ST which was indexed more than once and applies
+// the policy.  The conflicts are kept with the index so that they can be reported; with the strict
+// policy they are an error.
+func (i *Indexer) ResolveDuplicates(policy string) (err error) {
+	output := DuplicateProfiles{Conflicts: []ProfileConflict{}}
+	if output.Policy, err = normaliseDuplicates(policy); err != nil {
+		return
+	}
+	defer func() {
+		i.submissions = nil
+		if len(output.Conflicts) > 0 {
+			i.index.duplicates = &output
+		}
+	}()
+
+	STs := make([]CgmlstSt, 0, len(i.submissions))
+	for st := range i.submissions {
+		STs = append(STs, st)
+	}
+	sort.Slice(STs, func(a, b int) bool { return i.index.lookup[STs[a]] < i.index.lookup[STs[b]] })
+	for _, st := range STs {
+		submissions := i.submissions[st]
+		loci := compareSubmissions(submissions)
+		if len(loci) == 0 {
+			continue
+		}
+		output.Conflicts = append(output.Conflicts, ProfileConflict{st, len(submissions), loci})
+
+		switch output.Policy {
+		case DUPLICATES_FIRST:
+			for n := range loci {
+				loci[n].Kept = loci[n].Alleles[0]
+			}
+		case DUPLICATES_STRICT:
+			positions := make([]string, len(loci))
+			for n, conflict := range loci {
+				positions[n] = strconv.Itoa(conflict.Locus)
+			}
+			return newPipelineError(INVALID_INPUT, st, "the profiles of ST '%s' conflict at loci %s", st, strings.Join(positions, ", "))
+		case DUPLICATES_MAJORITY:
+			merged := submissions[0]
+			for _, conflict := range loci {
+				merged[conflict.Locus] = conflict.Kept
+			}
+			i.reindex(st, merged)
+		}
+	}
+	return nil
+}
+
+// reindex replaces the profile of an ST with the given alleles, keeping its metadata.
+func (i *Indexer) reindex(st CgmlstSt, alleles map[int]string) {
+	offset := i.index.lookup[st]
+	i.index.release(offset)
+	i.index.indices[offset] = BitProfiles{}
+
+	nLoci := 0
+	for locus := range alleles {
+		if locus >= nLoci {
+			nLoci = locus + 1
+		}
+	}
+	profile := Profile{ST: st, Matches: make([]string, nLoci), Metadata: i.index.metadata[st]}
+	for locus, allele := range alleles {
+		profile.Matches[locus] = allele
+	}
+	_, _ = i.Index(&profile)
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"github.com/goccy/go-json"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func duplicatesInput(policy string) io.Reader {
+	return strings.NewReader(strings.Join([]string{
+		`{"STs": ["A", "B"], "Threshold": 3, "Duplicates": "` + policy + `"}`,
+		`{}`,
+		`{"ST": "A", "Matches": ["1", "1", "2", ""]}`,
+		`{"ST": "B", "Matches": ["1", "1", "3", "1"]}`,
+		`{"ST": "A", "Matches": ["1", "1", "3", "1"]}`,
+		`{"ST": "A", "Matches": ["1", "1", "3", "1"]}`,
+		`{"ST": "B", "Matches": ["1", "1", "3", "1"]}`,
+	}, "\n"))
+}
+
+func TestDuplicates(t *testing.T) {
+	_, _, _, err := _main(context.Background(), duplicatesInput("strict"), &bytes.Buffer{}, Options{})
+	if pipelineErr, ok := err.(*PipelineError); !ok || pipelineErr.Code != INVALID_INPUT || pipelineErr.ST != "A" {
+		t.Fatalf("Expected the conflicting profiles of A to fail, got %v", err)
+	}
+	if _, _, _, err = _main(context.Background(), duplicatesInput("latest"), &bytes.Buffer{}, Options{}); err == nil {
+		t.Fatal("Expected an unknown policy to fail")
+	}
+
+	for policy, expected := range map[string][]int{"first": {1}, "majority": {0}} {
+		var output bytes.Buffer
+		_, _, distances, err := _main(context.Background(), duplicatesInput(policy), &output, Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(distances, expected) {
+			t.Fatalf("Expected %v with %s, got %v", expected, policy, distances)
+		}
+
+		var report DuplicateProfiles
+		decoder := json.NewDecoder(&output)
+		for {
+			var doc map[string]json.RawMessage
+			if err := decoder.Decode(&doc); err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if _, found := doc["conflicts"]; found {
+				raw, _ := json.Marshal(doc)
+				json.Unmarshal(raw, &report)
+			}
+		}
+		kept := map[string]string{"first": "2", "majority": "3"}[policy]
+		expectedReport := DuplicateProfiles{policy, []ProfileConflict{
+			{"A", 3, []LocusConflict{{2, []string{"2", "3", "3"}, kept}}},
+		}}
+		if !reflect.DeepEqual(report, expectedReport) {
+			t.Fatalf("Expected %+v, got %+v", expectedReport, report)
+		}
+	}
+}
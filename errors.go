@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// Error codes
+const (
+	INVALID_INPUT       = "INVALID_INPUT"       // the request, cache or a profile couldn't be read
+	MISSING_PROFILE     = "MISSING_PROFILE"     // a requested ST doesn't have a profile
+	INVALID_CACHE       = "INVALID_CACHE"       // the cache isn't consistent with itself or the request
+	CLUSTERING_FAILED   = "CLUSTERING_FAILED"   // the distances couldn't be clustered
+	OUTPUT_FAILED       = "OUTPUT_FAILED"       // the output or the cache file couldn't be written
+	CANCELLED           = "CANCELLED"           // the run was stopped or took longer than the maximum runtime
+	INSUFFICIENT_MEMORY = "INSUFFICIENT_MEMORY" // the run would need more memory than the limit
+)
+
+// Phases
+const (
+	PHASE_PARSING    = "parsing"
+	PHASE_PLANNING   = "planning"
+	PHASE_SCORING    = "scoring"
+	PHASE_CLUSTERING = "clustering"
+	PHASE_OUTPUT     = "output"
+)
+
+// Exit codes for each of the error codes.  EXIT_FAILURE is used for any other error.
+var exitCodes = map[string]int{
+	INVALID_INPUT:       3,
+	MISSING_PROFILE:     4,
+	INVALID_CACHE:       5,
+	CLUSTERING_FAILED:   6,
+	OUTPUT_FAILED:       7,
+	CANCELLED:           8,
+	INSUFFICIENT_MEMORY: 9,
+}
+
+// PipelineError says why and where the pipeline stopped, and which ST caused it if it was an ST.
+type PipelineError struct {
+	Code    string   `json:"code"`
+	Phase   string   `json:"phase"`
+	ST      CgmlstSt `json:"ST,omitempty"`
+	Message string   `json:"message"`
+}
+
+func (e *PipelineError) Error() string {
+	if e.ST != "" {
+		return fmt.Sprintf("%s while %s ST '%s': %s", e.Code, e.Phase, e.ST, e.Message)
+	}
+	return fmt.Sprintf("%s while %s: %s", e.Code, e.Phase, e.Message)
+}
+
+// ErrorOutput is the document written to the results when the pipeline fails.
+type ErrorOutput struct {
+	Error *PipelineError `json:"error"`
+}
+
+func newPipelineError(code string, st CgmlstSt, format string, a ...interface{}) *PipelineError {
+	return &PipelineError{Code: code, ST: st, Message: fmt.Sprintf(format, a...)}
+}
+
+// asPipelineError gives the error a code and a phase unless it already has them.
+func asPipelineError(err error, code string, phase string) *PipelineError {
+	var pipelineErr *PipelineError
+	if !errors.As(err, &pipelineErr) {
+		return &PipelineError{Code: code, Phase: phase, Message: err.Error()}
+	}
+	if pipelineErr.Phase == "" {
+		pipelineErr.Phase = phase
+	}
+	return pipelineErr
+}
+
+// cancelledError says why the context was cancelled.
+func cancelledError(ctx context.Context, phase string) *PipelineError {
+	message := "the run was cancelled"
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		message = "the maximum runtime was exceeded"
+	}
+	return &PipelineError{Code: CANCELLED, Phase: phase, Message: message}
+}
+
+// isCancelled is true if the error is from a cancelled run.
+func isCancelled(err error) bool {
+	var pipelineErr *PipelineError
+	return errors.As(err, &pipelineErr) && pipelineErr.Code == CANCELLED
+}
+
+// exitCode is the exit status for an error.
+func exitCode(err error) int {
+	var pipelineErr *PipelineError
+	if errors.As(err, &pipelineErr) {
+		if code, found := exitCodes[pipelineErr.Code]; found {
+			return code
+		}
+	}
+	return EXIT_FAILURE
+}
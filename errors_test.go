@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"github.com/goccy/go-json"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestErrorDocument(t *testing.T) {
+	input := strings.Join([]string{
+		`{"STs": ["A", "B", "C"], "Threshold": 2}`,
+		`{}`,
+		`{"ST": "A", "Matches": ["1", "1", "1"]}`,
+		`{"ST": "B", "Matches": ["1", "1", "2"]}`,
+	}, "\n")
+	var output bytes.Buffer
+	_, _, _, err := _main(context.Background(), strings.NewReader(input), &output, Options{})
+	if err == nil {
+		t.Fatal("Expected an error for the missing profile")
+	}
+	if code := exitCode(err); code != 4 {
+		t.Fatalf("Expected exit code 4, got %d", code)
+	}
+
+	var last map[string]json.RawMessage
+	decoder := json.NewDecoder(&output)
+	for {
+		var doc map[string]json.RawMessage
+		if err := decoder.Decode(&doc); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		last = doc
+	}
+	raw, found := last["error"]
+	if !found {
+		t.Fatalf("Expected the last document to be an error, got %v", last)
+	}
+	var pipelineErr PipelineError
+	if err := json.Unmarshal(raw, &pipelineErr); err != nil {
+		t.Fatal(err)
+	}
+	if pipelineErr.Code != MISSING_PROFILE || pipelineErr.Phase != PHASE_PARSING || pipelineErr.ST != "C" {
+		t.Fatalf("Expected a missing profile for C while parsing, got %+v", pipelineErr)
+	}
+}
+
+func TestAsPipelineError(t *testing.T) {
+	err := asPipelineError(newPipelineError(MISSING_PROFILE, "A", "not found"), INVALID_INPUT, PHASE_SCORING)
+	if err.Code != MISSING_PROFILE || err.Phase != PHASE_SCORING {
+		t.Fatalf("Expected the code to be kept and the phase to be set, got %+v", err)
+	}
+	err = asPipelineError(io.ErrUnexpectedEOF, INVALID_INPUT, PHASE_PARSING)
+	if err.Code != INVALID_INPUT || err.Phase != PHASE_PARSING || err.Message != io.ErrUnexpectedEOF.Error() {
+		t.Fatalf("Unexpected error %+v", err)
+	}
+	if code := exitCode(io.ErrUnexpectedEOF); code != EXIT_FAILURE {
+		t.Fatalf("Expected %d for an untyped error, got %d", EXIT_FAILURE, code)
+	}
+}
+
+func TestInconsistentCache(t *testing.T) {
+	input := strings.Join([]string{
+		`{"STs": ["A", "B"], "Threshold": 2}`,
+		`{"STs": ["A", "B"], "Pi": [1, 1], "Lambda": [1, 2147483647], "Threshold": 3, "Edges": {"1": [[0, 5]]}}`,
+		`{"ST": "A", "Matches": ["1", "1", "1"]}`,
+		`{"ST": "B", "Matches": ["1", "1", "2"]}`,
+	}, "\n")
+	var output bytes.Buffer
+	_, _, _, err := _main(context.Background(), strings.NewReader(input), &output, Options{})
+	if pipelineErr, ok := err.(*PipelineError); !ok || pipelineErr.Code != INVALID_CACHE {
+		t.Fatalf("Expected an INVALID_CACHE error, got %v", err)
+	}
+	if !strings.Contains(output.String(), `"code":"INVALID_CACHE"`) {
+		t.Fatalf("Expected an error document, got %s", output.String())
+	}
+}
@@ -1,9 +1,11 @@
 package main
 
 import (
-	"errors"
 	"fmt"
 	"github.com/RoaringBitmap/gocroaring"
+	"hash/fnv"
+	"sort"
+	"strconv"
 )
 
 type BitProfiles struct {
@@ -19,6 +21,7 @@ type AlleleKey struct {
 
 type Tokeniser struct {
 	lookup    map[AlleleKey]uint32
+	keys      []AlleleKey // the key of each token
 	nextValue chan uint32
 	lastValue uint32
 }
@@ -43,20 +46,59 @@ func (t *Tokeniser) Get(key AlleleKey) uint32 {
 	}
 	value := <-t.nextValue
 	t.lookup[key] = value
+	t.keys = append(t.keys, key)
 	t.lastValue = value
 	return value
 }
 
+// Lookup is like Get but doesn't make a token for a new key.
+func (t *Tokeniser) Lookup(key AlleleKey) (uint32, bool) {
+	value, ok := t.lookup[key]
+	return value, ok
+}
+
+// Key reverses Get.
+func (t *Tokeniser) Key(token uint32) AlleleKey {
+	return t.keys[token]
+}
+
 type ProfilesMap struct {
-	lookup     map[CgmlstSt]int
-	indices    []BitProfiles
-	schemeSize uint32
+	lookup       map[CgmlstSt]int
+	indices      []BitProfiles
+	schemeSize   uint32
+	metadata     map[CgmlstSt]Metadata  // only for the profiles which had some
+	rejected     []Rejection            // profiles which couldn't be indexed, in the order they were read
+	duplicates   *DuplicateProfiles     // the STs whose profiles conflict, if there were any
+	qc           map[CgmlstSt]ProfileQC // the counts which QualityControl doesn't need the other profiles for
+	alleleCounts []int                  // the number of profiles with each allele token
+	hashes       map[CgmlstSt]uint64    // a hash of the alleles of each profile
+}
+
+// Reasons for rejecting a profile
+const (
+	REJECTED_MISSING     = "missing"     // a requested ST didn't have a profile
+	REJECTED_MALFORMED   = "malformed"   // the profile couldn't be read
+	REJECTED_UNREQUESTED = "unrequested" // the profile's ST wasn't requested
+)
+
+// Rejection says why a profile wasn't clustered.
+type Rejection struct {
+	ST      CgmlstSt `json:"ST"`
+	Reason  string   `json:"reason"`
+	Message string   `json:"message"`
+}
+
+// RejectedProfiles is the output document listing the rejected profiles in lenient mode.
+type RejectedProfiles struct {
+	Rejected []Rejection `json:"rejected"`
 }
 
 type Indexer struct {
 	geneTokens   *Tokeniser
 	alleleTokens *Tokeniser
 	index        *ProfilesMap
+	free         []int                         // offsets of removed profiles
+	submissions  map[CgmlstSt][]map[int]string // every profile of the STs seen more than once
 }
 
 func NewIndexer(STs []CgmlstSt) (i *Indexer) {
@@ -72,6 +114,9 @@ func NewIndexer(STs []CgmlstSt) (i *Indexer) {
 			indices:    make([]BitProfiles, nSts),
 			lookup:     lookup,
 			schemeSize: ALMOST_INF,
+			metadata:   make(map[CgmlstSt]Metadata),
+			qc:         make(map[CgmlstSt]ProfileQC),
+			hashes:     make(map[CgmlstSt]uint64),
 		},
 	}
 }
@@ -85,25 +130,36 @@ func (i *Indexer) Index(profile *Profile) (bool, error) {
 	)
 
 	if offset, ok = i.index.lookup[profile.ST]; !ok {
-		return false, errors.New("Missing ST during indexing")
+		return false, fmt.Errorf("ST '%s' wasn't requested", profile.ST)
 	}
 	index = &i.index.indices[offset]
 	if index.Ready {
+		i.addSubmission(profile)
 		return true, nil
 	}
 	index.Genes = NewBitArray(2500)
 	index.Alleles = gocroaring.New()
 
 	var bit uint32
+	qc := ProfileQC{loci: len(profile.Matches)}
+	hash := fnv.New64a()
+	buf := make([]byte, 0, 64)
 	for gene, allele := range profile.Matches {
 		if allele == "" {
 			continue
 		}
+		buf = append(append(strconv.AppendInt(buf[:0], int64(gene), 10), ':'), allele...)
+		hash.Write(append(buf, ';'))
+		qc.Called++
+		if !isNumeric(allele) {
+			qc.NonNumeric++
+		}
 		bit = i.alleleTokens.Get(AlleleKey{
 			allele,
 			gene,
 		})
 		index.Alleles.Add(bit)
+		i.index.countAllele(bit, 1)
 		bit := i.geneTokens.Get(AlleleKey{
 			nil,
 			gene,
@@ -111,17 +167,177 @@ func (i *Indexer) Index(profile *Profile) (bool, error) {
 		index.Genes.SetBit(uint64(bit))
 	}
 	index.Ready = true
+	i.index.qc[profile.ST] = qc
+	i.index.hashes[profile.ST] = hash.Sum64()
+	if profile.Metadata != (Metadata{}) {
+		i.index.metadata[profile.ST] = profile.Metadata
+	}
 	if profile.schemeSize < i.index.schemeSize {
 		i.index.schemeSize = profile.schemeSize
 	}
 	return false, nil
 }
 
+// Complete returns an error if the profile of a requested ST was malformed or a requested ST wasn't
+// indexed.  Malformed profiles of the other STs are ignored like any other unrequested profile.
 func (i *ProfilesMap) Complete() error {
+	for _, rejection := range i.rejected {
+		if _, requested := i.lookup[rejection.ST]; requested && rejection.Reason == REJECTED_MALFORMED {
+			return newPipelineError(INVALID_INPUT, rejection.ST, "%s", rejection.Message)
+		}
+	}
+	if missing := i.Missing(); len(missing) > 0 {
+		return newPipelineError(MISSING_PROFILE, missing[0], "didn't see a profile for ST '%s'", missing[0])
+	}
+	return nil
+}
+
+// reject records a profile which couldn't be indexed.
+func (i *ProfilesMap) reject(rejection Rejection) {
+	i.rejected = append(i.rejected, rejection)
+}
+
+// Accept returns the STs which have been indexed in the same order, and lists the profiles which
+// were rejected.  A requested ST without a profile is malformed if a profile with its name couldn't
+// be read, otherwise it's missing.
+func (i *ProfilesMap) Accept(STs []CgmlstSt) ([]CgmlstSt, RejectedProfiles) {
+	malformed := make(map[CgmlstSt]Rejection)
+	for _, rejection := range i.rejected {
+		if _, seen := malformed[rejection.ST]; !seen && rejection.Reason == REJECTED_MALFORMED {
+			malformed[rejection.ST] = rejection
+		}
+	}
+
+	kept := make([]CgmlstSt, 0, len(STs))
+	output := RejectedProfiles{[]Rejection{}}
+	requested := make(map[CgmlstSt]bool, len(STs))
+	for _, st := range STs {
+		if requested[st] {
+			continue
+		}
+		requested[st] = true
+		if offset, found := i.lookup[st]; found && i.indices[offset].Ready {
+			kept = append(kept, st)
+		} else if rejection, found := malformed[st]; found {
+			output.Rejected = append(output.Rejected, rejection)
+		} else {
+			output.Rejected = append(output.Rejected, Rejection{st, REJECTED_MISSING, fmt.Sprintf("didn't see a profile for ST '%s'", st)})
+		}
+	}
+	for _, rejection := range i.rejected {
+		if !requested[rejection.ST] {
+			output.Rejected = append(output.Rejected, rejection)
+		}
+	}
+	return kept, output
+}
+
+// Missing lists the STs which haven't been indexed in the order they were requested.
+func (i *ProfilesMap) Missing() []CgmlstSt {
+	missing := make([]CgmlstSt, 0)
 	for st, idx := range i.lookup {
 		if !i.indices[idx].Ready {
-			return fmt.Errorf("didn't see a profile for ST '%s'", st)
+			missing = append(missing, st)
 		}
 	}
-	return nil
+	sort.Slice(missing, func(a, b int) bool {
+		return i.lookup[missing[a]] < i.lookup[missing[b]]
+	})
+	return missing
+}
+
+// Add indexes a profile, adding its ST to the index if it wasn't requested when the Indexer was
+// created.  It returns true if the ST was already indexed.
+func (i *Indexer) Add(profile *Profile) (bool, error) {
+	if _, found := i.index.lookup[profile.ST]; !found {
+		if n := len(i.free); n > 0 {
+			i.index.lookup[profile.ST] = i.free[n-1]
+			i.free = i.free[:n-1]
+		} else {
+			i.index.lookup[profile.ST] = len(i.index.indices)
+			i.index.indices = append(i.index.indices, BitProfiles{})
+		}
+	}
+	return i.Index(profile)
+}
+
+// Remove drops the profile of an ST from the index.  The space is reused by the next profile added.
+// Detached makes the bit profile of a profile without indexing it or making tokens for its alleles,
+// so that it can be compared with the indexed profiles and then freed.  An allele or a locus which
+// none of the indexed profiles have can't match them, so it is left out.
+func (i *Indexer) Detached(profile *Profile) BitProfiles {
+	detached := BitProfiles{Genes: NewBitArray(2500), Alleles: gocroaring.New(), Ready: true}
+	for gene, allele := range profile.Matches {
+		if allele == "" {
+			continue
+		}
+		if bit, found := i.alleleTokens.Lookup(AlleleKey{allele, gene}); found {
+			detached.Alleles.Add(bit)
+		}
+		if bit, found := i.geneTokens.Lookup(AlleleKey{nil, gene}); found {
+			detached.Genes.SetBit(uint64(bit))
+		}
+	}
+	return detached
+}
+
+func (i *Indexer) Remove(st CgmlstSt) bool {
+	offset, found := i.index.lookup[st]
+	if !found {
+		return false
+	}
+	delete(i.index.lookup, st)
+	delete(i.index.metadata, st)
+	delete(i.index.qc, st)
+	delete(i.index.hashes, st)
+	i.index.release(offset)
+	i.index.indices[offset] = BitProfiles{}
+	i.free = append(i.free, offset)
+	return true
+}
+
+// Subset returns a view of the index which only includes the given STs.  The profiles are shared
+// with the original index.  An error is returned if any of the STs haven't been indexed.
+func (i *ProfilesMap) Subset(STs []CgmlstSt) (*ProfilesMap, error) {
+	subset := &ProfilesMap{
+		lookup:       make(map[CgmlstSt]int, len(STs)),
+		indices:      i.indices,
+		schemeSize:   i.schemeSize,
+		metadata:     i.metadata,
+		qc:           i.qc,
+		alleleCounts: i.alleleCounts,
+		hashes:       i.hashes,
+	}
+	for _, st := range STs {
+		offset, found := i.lookup[st]
+		if !found || !i.indices[offset].Ready {
+			return nil, newPipelineError(MISSING_PROFILE, st, "didn't see a profile for ST '%s'", st)
+		}
+		subset.lookup[st] = offset
+	}
+	return subset, nil
+}
+
+// Called counts the loci which have an allele in the profile of an ST.
+func (i *ProfilesMap) Called(st CgmlstSt) (int, error) {
+	offset, found := i.lookup[st]
+	if !found || !i.indices[offset].Ready {
+		return 0, newPipelineError(MISSING_PROFILE, st, "didn't see a profile for ST '%s'", st)
+	}
+	return int(i.indices[offset].Alleles.Cardinality()), nil
+}
+
+// Alleles maps the position of each locus which is called in the profile of an ST to its allele.
+func (i *Indexer) Alleles(st CgmlstSt) (map[int]string, error) {
+	offset, found := i.index.lookup[st]
+	if !found || !i.index.indices[offset].Ready {
+		return nil, newPipelineError(MISSING_PROFILE, st, "didn't see a profile for ST '%s'", st)
+	}
+	tokens := i.index.indices[offset].Alleles.ToArray()
+	alleles := make(map[int]string, len(tokens))
+	for _, token := range tokens {
+		key := i.alleleTokens.Key(token)
+		alleles[key.Gene] = key.Allele.(string)
+	}
+	return alleles, nil
 }
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"github.com/goccy/go-json"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLenient(t *testing.T) {
+	input := strings.Join([]string{
+		`{"STs": ["A", "B", "C", "D"], "Threshold": 2}`,
+		`{}`,
+		`{"ST": "A", "Matches": ["1", "1", "1"]}`,
+		`{"ST": "D", "Matches": [1, 1, 2]}`,
+		`{"ST": "E", "Matches": ["1", "2", "2"]}`,
+		`{"ST": "B", "Matches": ["1", "1", "2"]}`,
+	}, "\n")
+
+	_, _, _, err := _main(context.Background(), strings.NewReader(input), &bytes.Buffer{}, Options{})
+	if code := exitCode(err); code != exitCodes[INVALID_INPUT] {
+		t.Fatalf("Expected the malformed profile to fail without lenient mode, got %v", err)
+	}
+
+	var output bytes.Buffer
+	STs, _, distances, err := _main(context.Background(), strings.NewReader(input), &output, Options{Lenient: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(STs, []CgmlstSt{"A", "B"}) || !reflect.DeepEqual(distances, []int{1}) {
+		t.Fatalf("Expected A and B to be clustered, got %v %v", STs, distances)
+	}
+
+	var rejected RejectedProfiles
+	decoder := json.NewDecoder(&output)
+	for {
+		var doc map[string]json.RawMessage
+		if err := decoder.Decode(&doc); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if raw, found := doc["rejected"]; found {
+			if err := json.Unmarshal(raw, &rejected.Rejected); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	reasons := make(map[CgmlstSt]string)
+	for _, rejection := range rejected.Rejected {
+		if rejection.Message == "" {
+			t.Fatalf("Expected a message for %s", rejection.ST)
+		}
+		reasons[rejection.ST] = rejection.Reason
+	}
+	expected := map[CgmlstSt]string{"C": REJECTED_MISSING, "D": REJECTED_MALFORMED, "E": REJECTED_UNREQUESTED}
+	if !reflect.DeepEqual(reasons, expected) {
+		t.Fatalf("Expected %v, got %v", expected, reasons)
+	}
+}
+
+func TestMalformedUnrequestedProfile(t *testing.T) {
+	input := strings.Join([]string{
+		`{"STs": ["A", "B"], "Threshold": 2}`,
+		`{}`,
+		`{"ST": "A", "Matches": ["1", "1", "1"]}`,
+		`{"ST": "E", "Matches": [1, 2, 2]}`,
+		`{"ST": "B", "Matches": ["1", "1", "2"]}`,
+	}, "\n")
+
+	STs, _, distances, err := _main(context.Background(), strings.NewReader(input), &bytes.Buffer{}, Options{})
+	if err != nil {
+		t.Fatalf("Expected the malformed profile of an unrequested ST to be ignored, got %v", err)
+	}
+	if !reflect.DeepEqual(STs, []CgmlstSt{"A", "B"}) || !reflect.DeepEqual(distances, []int{1}) {
+		t.Fatalf("Expected A and B to be clustered, got %v %v", STs, distances)
+	}
+}
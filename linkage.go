@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// Linkage methods
+const (
+	SINGLE_LINKAGE   = "single"
+	COMPLETE_LINKAGE = "complete"
+	AVERAGE_LINKAGE  = "average" // UPGMA
+)
+
+// normaliseLinkage defaults to single linkage and checks that the method is known.
+func normaliseLinkage(linkage string) (string, error) {
+	switch linkage {
+	case "", SINGLE_LINKAGE:
+		return SINGLE_LINKAGE, nil
+	case COMPLETE_LINKAGE, AVERAGE_LINKAGE:
+		return linkage, nil
+	}
+	return "", newPipelineError(INVALID_INPUT, "", "unknown linkage '%s'", linkage)
+}
+
+// Agglomerate clusters the items with complete or average linkage using the nearest-neighbour
+// chain algorithm.  It needs a copy of the distances so uses twice as much memory as SLINK.  The
+// merges are returned in order of distance.  It stops with an error if the context is cancelled.
+func Agglomerate(ctx context.Context, distances []int, nItems int, linkage string) ([]Merge, error) {
+	if len(distances) != (nItems*(nItems-1))/2 {
+		return nil, fmt.Errorf("Wrong number of distances given")
+	}
+	var update func(dA, dB float64, sizeA, sizeB int) float64
+	switch linkage {
+	case COMPLETE_LINKAGE:
+		update = func(dA, dB float64, sizeA, sizeB int) float64 {
+			return math.Max(dA, dB)
+		}
+	case AVERAGE_LINKAGE:
+		update = func(dA, dB float64, sizeA, sizeB int) float64 {
+			return (dA*float64(sizeA) + dB*float64(sizeB)) / float64(sizeA+sizeB)
+		}
+	default:
+		return nil, fmt.Errorf("can't agglomerate with %s linkage", linkage)
+	}
+
+	d := make([]float64, len(distances))
+	for i, distance := range distances {
+		d[i] = float64(distance)
+	}
+	idx := func(a, b int) int {
+		if a < b {
+			a, b = b, a
+		}
+		return (a*(a-1))/2 + b
+	}
+
+	// Each cluster is stored in the slot of one of its items
+	size := make([]int, nItems)
+	active := make([]bool, nItems)
+	for i := range size {
+		size[i] = 1
+		active[i] = true
+	}
+
+	steps := make([]Merge, 0, nItems)
+	chain := make([]int, 0, nItems)
+	next := 0 // lowest slot which might still be active
+	for len(steps) < nItems-1 {
+		if ctx.Err() != nil {
+			return nil, cancelledError(ctx, PHASE_CLUSTERING)
+		}
+		if len(chain) == 0 {
+			for !active[next] {
+				next++
+			}
+			chain = append(chain, next)
+		}
+		a := chain[len(chain)-1]
+		previous := -1
+		if len(chain) > 1 {
+			previous = chain[len(chain)-2]
+		}
+
+		// Find the nearest neighbour, preferring the previous item in the chain on a tie
+		b, best := previous, math.Inf(1)
+		if previous >= 0 {
+			best = d[idx(a, previous)]
+		}
+		for k := 0; k < nItems; k++ {
+			if !active[k] || k == a {
+				continue
+			}
+			if distance := d[idx(a, k)]; distance < best {
+				b, best = k, distance
+			}
+		}
+
+		if b != previous {
+			chain = append(chain, b)
+			continue
+		}
+
+		// a and b are reciprocal nearest neighbours so merge them into b's slot
+		chain = chain[:len(chain)-2]
+		steps = append(steps, Merge{a, b, best, size[a] + size[b]})
+		for k := 0; k < nItems; k++ {
+			if !active[k] || k == a || k == b {
+				continue
+			}
+			d[idx(k, b)] = update(d[idx(k, a)], d[idx(k, b)], size[a], size[b])
+		}
+		active[a] = false
+		size[b] += size[a]
+	}
+
+	// Replay the merges in order of distance to number the nodes
+	sort.SliceStable(steps, func(i, j int) bool {
+		return steps[i].Distance < steps[j].Distance
+	})
+	parent := make([]int, nItems)
+	node := make([]int, nItems)
+	for i := range parent {
+		parent[i] = i
+		node[i] = i
+	}
+	find := func(i int) int {
+		for parent[i] != i {
+			parent[i] = parent[parent[i]]
+			i = parent[i]
+		}
+		return i
+	}
+	merges := make([]Merge, len(steps))
+	for k, step := range steps {
+		a, b := find(step.A), find(step.B)
+		if node[a] > node[b] {
+			a, b = b, a
+		}
+		merges[k] = Merge{node[a], node[b], step.Distance, step.Size}
+		parent[a] = b
+		node[b] = nItems + k
+	}
+	return merges, nil
+}
+
+// pointerRepresentation converts a dendrogram into pi and lambda so that it can be cut with Get and
+// saved like the output of SLINK.  lambda is rounded up so that cutting at an integer threshold
+// gives the same clusters as cutting the dendrogram.
+func pointerRepresentation(merges []Merge, nItems int) Clusters {
+	c := Clusters{make([]int, nItems), make([]int, nItems), nItems}
+	last := make([]int, nItems+len(merges)) // the biggest item in each node
+	for i := 0; i < nItems; i++ {
+		c.pi[i] = i
+		c.lambda[i] = ALMOST_INF
+		last[i] = i
+	}
+	for k, m := range merges {
+		a, b := last[m.A], last[m.B]
+		if a > b {
+			a, b = b, a
+		}
+		c.pi[a] = b
+		c.lambda[a] = int(math.Min(math.Ceil(m.Distance), ALMOST_INF))
+		last[nItems+k] = b
+	}
+	return c
+}
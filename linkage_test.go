@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestAgglomerate(t *testing.T) {
+	// A-1-B-2-C-4-D
+	distances := []int{
+		1,
+		3, 2,
+		7, 6, 4,
+	}
+
+	merges, err := Agglomerate(context.Background(), distances, 4, COMPLETE_LINKAGE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []Merge{
+		{0, 1, 1, 2},
+		{2, 4, 3, 3},
+		{3, 5, 7, 4},
+	}
+	if !reflect.DeepEqual(merges, expected) {
+		t.Fatalf("Expected %v, got %v", expected, merges)
+	}
+
+	if merges, err = Agglomerate(context.Background(), distances, 4, AVERAGE_LINKAGE); err != nil {
+		t.Fatal(err)
+	}
+	expected = []Merge{
+		{0, 1, 1, 2},
+		{2, 4, 2.5, 3},
+		{3, 5, 17.0 / 3, 4},
+	}
+	if !reflect.DeepEqual(merges, expected) {
+		t.Fatalf("Expected %v, got %v", expected, merges)
+	}
+
+	clusters := pointerRepresentation(merges, 4)
+	for threshold, expected := range map[int][]int{
+		0: {0, 1, 2, 3},
+		2: {1, 1, 2, 3},
+		3: {2, 2, 2, 3},
+		6: {3, 3, 3, 3},
+	} {
+		if actual := clusters.Get(threshold); !reflect.DeepEqual(actual, expected) {
+			t.Fatalf("Expected %v at threshold %d, got %v", expected, threshold, actual)
+		}
+	}
+
+	if _, err = Agglomerate(context.Background(), distances, 4, "ward"); err == nil {
+		t.Fatal("Expected an error for an unknown linkage")
+	}
+}
+
+func TestSingleLinkageDoesNotReuseOtherCaches(t *testing.T) {
+	request := `{"STs": ["A", "B", "C", "D", "E"], "Threshold": 3}`
+	cache := `{"STs": ["A", "B", "C"], "pi": [1, 2, 2], "lambda": [1, 2, 2147483647], "threshold": 3, "linkage": "complete", "edges": {}}`
+	progress, stopProgress := backgroundProgress(false)
+	defer stopProgress()
+	parsed, parsedCache, indexer, err := parse(context.Background(), fakeInput(request, cache, fakeProfiles), "", progress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	scores, err := NewScores(parsed, &parsedCache, indexer.index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if scores.canReuseCache {
+		t.Fatal("Expected a complete linkage cache not to be reused for single linkage")
+	}
+}
@@ -2,27 +2,111 @@ package main
 
 import (
 	"bufio"
-	"encoding/json"
+	"context"
+	"errors"
 	"flag"
 	"io"
+	"io/fs"
 	"log"
 	"os"
+	"os/signal"
 	"runtime/pprof"
+	"syscall"
 	"time"
 )
 
 var cpuprofile = flag.String("cpuprofile", "", "write cpu profile to file")
+var cacheIn = flag.String("cache-in", "", "read the cache from this file rather than from stdin")
+var cacheOut = flag.String("cache-out", "", "write the clustering to this file so it can be used as a cache")
+var maxRuntime = flag.Duration("max-runtime", 0, "stop with a CANCELLED error after this long, e.g. 30m (default no limit)")
+var checkpoint = flag.String("checkpoint", "", "save the scores to this file while they're being calculated")
+var checkpointEvery = flag.Duration("checkpoint-every", CHECKPOINT_INTERVAL, "how often to save the checkpoint")
+var resume = flag.Bool("resume", false, "load the scores saved to the checkpoint and only calculate the rest")
+var memoryLimit memoryLimitFlag
+var progressSink = flag.String("progress", PROGRESS_STDOUT, PROGRESS_USAGE)
+var envelope = flag.Bool("envelope", false, ENVELOPE_USAGE)
+var metricsAddr = flag.String("metrics", "", METRICS_USAGE)
+
+// Options are the settings which aren't part of the request document.
+type Options struct {
+	CacheIn      string            // path of a cache file, if empty the cache is read from the input
+	CacheOut     string            // path to save the result as a cache file
+	Threshold    *int              // overrides the threshold given in the request
+	Workers      int               // number of scoring workers, defaults to one more than the number of CPUs
+	Linkage      string            // overrides the linkage given in the request
+	Summaries    bool              // send the cluster summaries even if the request doesn't ask for them
+	Recommend    *RecommendRequest // send the ThresholdReport even if the request doesn't ask for it
+	FloatCopy    bool              // the distances are copied as float64s, e.g. for a neighbour-joining tree, which the memory plan counts
+	AllDistances bool              // ignore the cache so that the distances above the threshold are calculated too
+	Lenient      bool              // drop the STs whose profiles are missing or malformed even if the request doesn't
+	MaxRuntime   time.Duration     // cancel the run after this long if it's positive
+
+	Checkpoint         string        // path to save the scores to while they're being calculated
+	CheckpointInterval time.Duration // how often to save the checkpoint, defaults to CHECKPOINT_INTERVAL
+	Resume             bool          // load the scores which were saved to the checkpoint before scoring
+	MemoryLimit        int64         // in bytes, 0 uses the cgroup's limit and NO_MEMORY_LIMIT turns the check off
+	Progress           string        // where to send the progress messages, see openProgressSink
+	Envelope           bool          // wrap each document written to the results with its type
+}
+
+// apply overrides the settings in the request.
+func (opts Options) apply(request *Request) {
+	if opts.Threshold != nil {
+		request.Threshold = *opts.Threshold
+	}
+	if opts.Linkage != "" {
+		request.Linkage = opts.Linkage
+	}
+	if opts.Summaries {
+		request.Summaries = true
+	}
+	if opts.Lenient {
+		request.Lenient = true
+	}
+	if opts.Recommend != nil {
+		request.Recommend = opts.Recommend
+	}
+}
+
+// withMaxRuntime cancels the context once the maximum runtime has passed, if there is one.
+func (opts Options) withMaxRuntime(ctx context.Context) (context.Context, context.CancelFunc) {
+	if opts.MaxRuntime <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, opts.MaxRuntime)
+}
+
+// signalContext is cancelled by SIGINT or SIGTERM.
+func signalContext() (context.Context, context.CancelFunc) {
+	return signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+}
 
 func main() {
+	os.Exit(run())
+}
+
+// run is main without the call to os.Exit, so that the deferred calls which stop the CPU profile and
+// the metrics server have run before the program exits with the code it returns.
+func run() int {
+	if len(os.Args) > 1 {
+		if command, found := commands[os.Args[1]]; found {
+			return command.run(os.Args[2:])
+		}
+	}
+
+	flag.Var(&memoryLimit, "memory-limit", MEMORY_LIMIT_USAGE)
 	flag.Parse()
 	if *cpuprofile != "" {
 		f, err := os.Create(*cpuprofile)
 		if err != nil {
-			log.Fatal(err)
+			log.Println(err)
+			return EXIT_FAILURE
 		}
+		defer f.Close()
 		err = pprof.StartCPUProfile(f)
 		if err != nil {
-			log.Fatal(err)
+			log.Println(err)
+			return EXIT_FAILURE
 		}
 		defer pprof.StopCPUProfile()
 	}
@@ -31,98 +115,406 @@ func main() {
 	//	panic(err)
 	//}
 
+	defer serveMetrics(*metricsAddr)()
+	ctx, stop := signalContext()
 	var stdinReader = bufio.NewReaderSize(os.Stdin, 16000000)
-	_main(stdinReader, os.Stdout)
+	_, _, _, err := _main(ctx, stdinReader, os.Stdout, Options{
+		CacheIn:            *cacheIn,
+		CacheOut:           *cacheOut,
+		MaxRuntime:         *maxRuntime,
+		Checkpoint:         *checkpoint,
+		CheckpointInterval: *checkpointEvery,
+		Resume:             *resume,
+		MemoryLimit:        int64(memoryLimit),
+		Progress:           *progressSink,
+		Envelope:           *envelope,
+	})
+	stop()
+	if err != nil {
+		log.Println(err)
+		return exitCode(err)
+	}
+	return EXIT_OK
 }
 
-func _main(r io.Reader, w io.Writer) ([]CgmlstSt, Clusters, []int) {
+// _main runs the whole pipeline.  If it fails an ErrorOutput document is written after any results
+// which were sent and the error is returned as a *PipelineError.  The run stops with a CANCELLED
+// error if the context is cancelled or the maximum runtime passes.
+func _main(ctx context.Context, r io.Reader, w io.Writer, opts Options) (STs []CgmlstSt, clusters Clusters, distances []int, err error) {
 	log.SetFlags(log.Lmicroseconds)
-	enc := json.NewEncoder(w)
+	ctx, cancel := opts.withMaxRuntime(ctx)
+	defer cancel()
+	sink, sinkErr := openProgressSink(opts.Progress)
+	if sink != nil {
+		defer sink.Close()
+	}
+	var progressTo io.Writer = sink
+	if sinkErr != nil {
+		// The progress is dropped if its sink couldn't be opened
+		progressTo = io.Discard
+	}
+	enc := newDocumentEncoder(w, progressTo, opts.Envelope)
 	progressIn, progressOut := NewProgressWorker()
-	defer func() { progressIn <- ProgressEvent{EXIT, 0} }()
-	results := make(chan ClusterOutput, 100)
+	results := make(chan interface{}, 100)
+	done := writeDocuments(enc, progressOut, results)
+	defer func() {
+		var pipelineErr *PipelineError
+		if err != nil {
+			pipelineErr = err.(*PipelineError)
+		}
+		finishDocuments(enc, progressIn, results, done, pipelineErr)
+	}()
+	if sinkErr != nil {
+		err = asPipelineError(sinkErr, OUTPUT_FAILED, PHASE_OUTPUT)
+		return
+	}
+
+	request, cache, indexer, err := parseChecked(ctx, r, opts.CacheIn, planRequest(opts, true), progressIn)
+	if err != nil {
+		err = asPipelineError(err, INVALID_INPUT, PHASE_PARSING)
+		return
+	}
 
-	done := make(chan bool)
+	var cacheOutput *ClusterOutput
+	if opts.CacheOut != "" {
+		output := NewCacheOutput()
+		cacheOutput = &output
+	}
+	scores, clusters, err := runClustering(ctx, request, &cache, indexer.index, opts, progressIn, results, cacheOutput)
+	if err != nil {
+		err = asPipelineError(err, CLUSTERING_FAILED, PHASE_CLUSTERING)
+		return
+	}
+
+	if opts.CacheOut != "" {
+		if err = WriteCacheFile(opts.CacheOut, *cacheOutput); err != nil {
+			err = asPipelineError(err, OUTPUT_FAILED, PHASE_OUTPUT)
+			return
+		}
+	}
+	return scores.STs, clusters, scores.scores, nil
+}
+
+// writeDocuments encodes the progress messages and results as they arrive.  The returned channel is
+// closed once both channels have been closed and everything has been written, so the progress
+// worker has to be stopped first.  Once a document can't be written the rest are read and dropped,
+// so that neither the pipeline nor the progress worker blocks on a full channel.
+func writeDocuments(enc *documentEncoder, progress chan ProgressMessage, results chan interface{}) (done chan bool) {
+	done = make(chan bool)
 	go func() {
-		for {
+		defer close(done)
+		var err error
+		for progress != nil || results != nil {
 			select {
-			case progress := <-progressOut:
-				err := enc.Encode(progress)
-				if err != nil {
-					return
+			case message, more := <-progress:
+				if !more {
+					progress = nil
+				} else if err == nil {
+					err = enc.encodeProgress(message)
 				}
 			case result, more := <-results:
-				if more {
-					err := enc.Encode(result)
-					if err != nil {
-						return
-					}
-				} else {
-					done <- true
+				if !more {
+					results = nil
+				} else if err == nil {
+					err = enc.encodeResult(result)
 				}
 			}
 		}
 	}()
+	return
+}
 
-	request, cache, index, err := parse(r, progressIn)
-	if err := index.Complete(); err != nil {
-		panic(err)
+// finishDocuments stops the progress worker and waits for the documents to be written.  If the run
+// failed the error document is written last, after a final "Cancelled" progress message if the run
+// was cancelled.
+func finishDocuments(enc *documentEncoder, progress chan ProgressEvent, results chan interface{}, done chan bool, err *PipelineError) {
+	if err != nil && err.Code == CANCELLED {
+		progress <- ProgressEvent{RUN_CANCELLED, 0}
+	} else if err != nil {
+		progress <- ProgressEvent{RUN_FAILED, 0}
+	}
+	progress <- ProgressEvent{EXIT, 0}
+	close(results)
+	<-done
+	if err == nil {
+		return
 	}
+	if encodeErr := enc.encodeResult(ErrorOutput{err}); encodeErr != nil {
+		log.Println(encodeErr)
+	}
+}
 
-	var scores ScoresStore
-	if scores, err = NewScores(request, &cache, index); err != nil {
-		panic(err)
+// runClustering scores and clusters the requested STs and sends the output documents to results.
+// If cacheOutput isn't nil the documents are also merged into it.
+func runClustering(ctx context.Context, request Request, cache *Cache, index *ProfilesMap, opts Options, progress chan ProgressEvent, results chan interface{}, cacheOutput *ClusterOutput) (scores ScoresStore, clusters Clusters, err error) {
+	opts.apply(&request)
+	if request.Temporal != nil && request.Temporal.Alleles > request.Threshold {
+		err = newPipelineError(INVALID_INPUT, "", "temporal clusters can't use more alleles (%d) than the threshold (%d)", request.Temporal.Alleles, request.Threshold)
+		err = asPipelineError(err, INVALID_INPUT, PHASE_PARSING)
+		return
+	}
+	if request.Recommend != nil && (request.Recommend.Max < 0 || request.Recommend.Candidates < 0) {
+		err = newPipelineError(INVALID_INPUT, "", "the recommended thresholds need a positive maximum and number of candidates")
+		err = asPipelineError(err, INVALID_INPUT, PHASE_PARSING)
+		return
+	}
+	if err = cache.Validate(); err != nil {
+		err = asPipelineError(err, INVALID_CACHE, PHASE_PARSING)
+		return
+	}
+	if index.duplicates != nil {
+		results <- *index.duplicates
+	}
+	scoring, index, err := requestedProfiles(request, index, results)
+	if err != nil {
+		return
+	}
+	var plan MemoryPlan
+	if plan, err = planMemory(scoring, opts, canStream(scoring, opts)); err != nil {
+		return
 	}
 
-	progressIn <- ProgressEvent{CACHED_SCORES_EXPECTED, scores.Done()}
+	var distances *[]int
+	var merges []Merge
+	var output chan ClusterOutput
+	if plan.Strategy == STRATEGY_STREAMING {
+		if opts.Checkpoint != "" {
+			log.Printf("Streamed runs aren't checkpointed, ignoring %s\n", opts.Checkpoint)
+		}
+		var edges [][][2]int
+		if scores.STs, clusters, edges, err = streamClustering(ctx, scoring, cache, index, opts.Workers, progress); err != nil {
+			err = asPipelineError(err, CLUSTERING_FAILED, PHASE_CLUSTERING)
+			return
+		}
+		output = clusters.formatEdges(ctx, request.Threshold, func(t int) [][2]int { return edges[t] }, scores.STs)
+	} else {
+		if scores, err = scoreSTs(ctx, scoring, cache, index, opts, progress); err != nil {
+			return
+		}
+		if distances, err = scores.Distances(); err != nil {
+			return
+		}
+		if clusters, merges, err = clusterScores(ctx, &scores, cache, request.Linkage, progress); err != nil {
+			err = asPipelineError(err, CLUSTERING_FAILED, PHASE_CLUSTERING)
+			return
+		}
+		output = clusters.Format(ctx, request.Threshold, *distances, scores.STs)
+	}
 
-	tick := time.Tick(time.Second)
-	go func() {
-		for {
-			<-tick
-			log.Printf("%d scores remaining\n", scores.Todo())
+	nResults := request.Threshold + 1
+	if request.Summaries {
+		nResults *= 2
+	}
+	progress <- ProgressEvent{RESULTS_TO_SAVE, nResults}
+	for c := range output {
+		if len(c.Sts) > 0 && merges != nil {
+			c.Linkage = request.Linkage
+			c.Dendrogram = merges
 		}
-	}()
+		if request.TimeEdges && len(c.Edges) > 0 {
+			c.Days = edgeDays(c.Edges, scores.STs, index.metadata)
+		}
+		results <- c
+		if cacheOutput != nil {
+			cacheOutput.Merge(c)
+		}
+		progress <- ProgressEvent{SAVED_RESULT, 1}
+	}
+	if ctx.Err() != nil {
+		err = cancelledError(ctx, PHASE_OUTPUT)
+		return
+	}
 
-	scoreComplete, errChan := scores.RunScoring(*index, progressIn)
+	if request.Summaries {
+		known := ALMOST_INF
+		if scores.cacheSize > 1 {
+			known = cache.Threshold
+		}
+		for _, summaries := range clusters.Summarise(request.Threshold, *distances, scores.STs, known) {
+			results <- summaries
+			progress <- ProgressEvent{SAVED_RESULT, 1}
+		}
+	}
+	if request.Temporal != nil {
+		results <- FindTemporalClusters(*request.Temporal, &scores, index.metadata)
+	}
+	recommend(request, *distances, clusters, results)
+	return
+}
 
-	select {
-	case err := <-errChan:
-		if err != nil {
-			panic(err)
+// scoreInput parses the request, cache and profiles and then calculates the distance between every
+// pair of requested STs.
+func scoreInput(ctx context.Context, r io.Reader, opts Options, progress chan ProgressEvent) (request Request, cache Cache, index *ProfilesMap, scores ScoresStore, err error) {
+	var indexer *Indexer
+	if request, cache, indexer, err = parseChecked(ctx, r, opts.CacheIn, planRequest(opts, false), progress); err != nil {
+		return
+	}
+	index = indexer.index
+	opts.apply(&request)
+	scores, err = runScores(ctx, request, &cache, index, opts, progress)
+	return
+}
+
+// requestedProfiles checks that the requested STs have profiles and applies the QC limits and the
+// filter.  The index is narrowed to the remaining STs if any were dropped.  If results isn't nil the
+// rejected profiles and the QC report are sent to it.
+func requestedProfiles(request Request, index *ProfilesMap, results chan interface{}) (Request, *ProfilesMap, error) {
+	var err error
+	if request.Lenient {
+		var rejected RejectedProfiles
+		request.STs, rejected = index.Accept(request.STs)
+		if results != nil {
+			results <- rejected
+		}
+	} else if err = index.Complete(); err != nil {
+		err = asPipelineError(err, MISSING_PROFILE, PHASE_PARSING)
+		return request, index, err
+	}
+	if request.QC != nil {
+		var report QCReport
+		request.STs, report = index.QualityControl(request.STs, *request.QC)
+		if results != nil {
+			results <- report
+		}
+	}
+	if request.Linkage, err = normaliseLinkage(request.Linkage); err != nil {
+		err = asPipelineError(err, INVALID_INPUT, PHASE_PARSING)
+		return request, index, err
+	}
+	if request.Filter != nil {
+		if request.STs, err = request.Filter.Apply(request.STs, index.metadata); err != nil {
+			err = asPipelineError(err, INVALID_INPUT, PHASE_PARSING)
+			return request, index, err
+		}
+	}
+	if request.Lenient || request.Filter != nil || request.QC != nil {
+		// Only score the remaining STs, even if the cache has the others
+		if index, err = index.Subset(request.STs); err != nil {
+			err = asPipelineError(err, MISSING_PROFILE, PHASE_PARSING)
+			return request, index, err
 		}
-	case <-scoreComplete:
 	}
-	log.Printf("%d scores remaining\n", scores.Todo())
+	return request, index, nil
+}
 
-	progressIn <- ProgressEvent{CLUSTERING_STARTED, 0}
+// runScores calculates the distance between every pair of requested STs.  If the context is
+// cancelled it waits for the workers to stop and returns a CANCELLED error.
+func runScores(ctx context.Context, request Request, cache *Cache, index *ProfilesMap, opts Options, progress chan ProgressEvent) (scores ScoresStore, err error) {
+	if err = cache.Validate(); err != nil {
+		err = asPipelineError(err, INVALID_CACHE, PHASE_PARSING)
+		return
+	}
+	if request, index, err = requestedProfiles(request, index, nil); err != nil {
+		return
+	}
+	if _, err = planMemory(request, opts, false); err != nil {
+		return
+	}
+	return scoreSTs(ctx, request, cache, index, opts, progress)
+}
 
+// scoreSTs is runScores for a request which has already been through requestedProfiles.
+func scoreSTs(ctx context.Context, request Request, cache *Cache, index *ProfilesMap, opts Options, progress chan ProgressEvent) (scores ScoresStore, err error) {
+	if request.Linkage != SINGLE_LINKAGE || request.Recommend != nil || opts.AllDistances {
+		// The cached clustering can't be extended and the other linkages and the recommended
+		// thresholds need every distance
+		cache = NewCache()
+	}
+
+	if scores, err = NewScores(request, cache, index); err != nil {
+		err = asPipelineError(err, INVALID_CACHE, PHASE_SCORING)
+		return
+	}
+
+	var fingerprint string
+	var checkpoints <-chan time.Time
+	if opts.Checkpoint != "" {
+		fingerprint = index.Fingerprint(scores.STs)
+		if opts.Resume {
+			var rows int
+			if rows, err = scores.ResumeCheckpoint(opts.Checkpoint, fingerprint); errors.Is(err, fs.ErrNotExist) {
+				log.Printf("There is no checkpoint at %s, scoring from the start\n", opts.Checkpoint)
+			} else if err != nil {
+				err = asPipelineError(err, INVALID_CACHE, PHASE_SCORING)
+				return
+			} else {
+				log.Printf("Resumed %d rows of scores from %s\n", rows, opts.Checkpoint)
+			}
+			err = nil
+		}
+		interval := opts.CheckpointInterval
+		if interval <= 0 {
+			interval = CHECKPOINT_INTERVAL
+		}
+		checkpointTicker := time.NewTicker(interval)
+		defer checkpointTicker.Stop()
+		checkpoints = checkpointTicker.C
+	}
+	checkpoint := func() {
+		if opts.Checkpoint == "" {
+			return
+		}
+		// A run shouldn't fail because it couldn't be checkpointed
+		if err := scores.WriteCheckpoint(opts.Checkpoint, fingerprint); err != nil {
+			log.Printf("Couldn't write the checkpoint: %s\n", err)
+		}
+	}
+
+	progress <- ProgressEvent{SCORES_EXPECTED, len(scores.scores)}
+	progress <- ProgressEvent{CACHED_SCORES_EXPECTED, scores.Done()}
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	scoreComplete, errChan := scores.RunScoring(ctx, *index, opts.Workers, progress)
+
+	for {
+		select {
+		case <-ctx.Done():
+			<-scoreComplete
+			checkpoint()
+			err = cancelledError(ctx, PHASE_SCORING)
+			return
+		case err = <-errChan:
+			if err != nil {
+				return
+			}
+		case <-scoreComplete:
+			log.Printf("%d scores remaining\n", scores.Todo())
+			checkpoint()
+			return
+		case <-ticker.C:
+			log.Printf("%d scores remaining\n", scores.Todo())
+		case <-checkpoints:
+			checkpoint()
+		}
+	}
+}
+
+// clusterScores runs SLINK over the scores, extending the cached clustering if it can be reused.
+// Complete and average linkage also return the dendrogram.
+func clusterScores(ctx context.Context, scores *ScoresStore, cache *Cache, linkage string, progress chan ProgressEvent) (clusters Clusters, merges []Merge, err error) {
 	var distances *[]int
 	if distances, err = scores.Distances(); err != nil {
-		panic(err)
+		return
 	}
 	nItems := len(scores.STs)
 
-	var clusters Clusters
-	if scores.canReuseCache {
-		clusters, err = ClusterFromCache(*distances, nItems, &cache)
-		if err != nil {
-			panic(err)
-		}
-	} else {
-		clusters, err = ClusterFromScratch(*distances, nItems)
-		if err != nil {
-			panic(err)
+	if linkage, err = normaliseLinkage(linkage); err != nil {
+		return
+	} else if linkage != SINGLE_LINKAGE {
+		progress <- ProgressEvent{CLUSTERING_STARTED, nItems}
+		if merges, err = Agglomerate(ctx, *distances, nItems, linkage); err != nil {
+			return
 		}
+		clusters = pointerRepresentation(merges, nItems)
+		progress <- ProgressEvent{STS_CLUSTERED, nItems}
+		return
 	}
 
-	progressIn <- ProgressEvent{RESULTS_TO_SAVE, request.Threshold + 1}
-	for c := range clusters.Format(request.Threshold, *distances, scores.STs) {
-		results <- c
-		progressIn <- ProgressEvent{SAVED_RESULT, 1}
+	if !scores.canReuseCache {
+		cache = NewCache()
 	}
-
-	close(results)
-	<-done
-	return scores.STs, clusters, *distances
+	progress <- ProgressEvent{CLUSTERING_STARTED, nItems - len(cache.Pi)}
+	clusters, err = clusterFromCache(ctx, *distances, nItems, cache, progress)
+	return
 }
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/goccy/go-json"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Distance returns the distance between two STs by their index.  An ST is 0 from itself.
+func (s *ScoresStore) Distance(stA int, stB int) int {
+	if stA == stB {
+		return 0
+	}
+	idx, _ := GetIndex(stA, stB)
+	return s.scores[idx]
+}
+
+// matrixValue formats a distance, replacing those which couldn't be calculated with missing.
+func matrixValue(distance int, missing string) string {
+	if distance < 0 || distance >= ALMOST_INF {
+		return missing
+	}
+	return strconv.Itoa(distance)
+}
+
+// WriteMatrixTSV writes the square matrix with the STs as the header and first column.  Distances
+// which couldn't be calculated are written as NA.
+func WriteMatrixTSV(w io.Writer, s *ScoresStore) error {
+	buf := bufio.NewWriter(w)
+	buf.WriteString("ST")
+	for _, st := range s.STs {
+		buf.WriteString("\t" + st)
+	}
+	buf.WriteByte('\n')
+	for a, st := range s.STs {
+		buf.WriteString(st)
+		for b := range s.STs {
+			buf.WriteString("\t" + matrixValue(s.Distance(a, b), "NA"))
+		}
+		buf.WriteByte('\n')
+	}
+	return buf.Flush()
+}
+
+// WritePhylip writes the lower-triangular matrix in PHYLIP format.  Names are padded to ten
+// characters but longer names are kept whole (as relaxed PHYLIP allows) so spaces are replaced.
+// Distances which couldn't be calculated are written as -1.
+func WritePhylip(w io.Writer, s *ScoresStore) error {
+	buf := bufio.NewWriter(w)
+	fmt.Fprintf(buf, "%d\n", len(s.STs))
+	for a, st := range s.STs {
+		fmt.Fprintf(buf, "%-10s", strings.ReplaceAll(st, " ", "_"))
+		for b := 0; b < a; b++ {
+			buf.WriteString(" " + matrixValue(s.Distance(a, b), "-1"))
+		}
+		buf.WriteByte('\n')
+	}
+	return buf.Flush()
+}
+
+// WriteMega writes the lower-left matrix in MEGA format.  Distances which couldn't be calculated
+// are written as ?.
+func WriteMega(w io.Writer, s *ScoresStore) error {
+	buf := bufio.NewWriter(w)
+	buf.WriteString("#mega\n!Title: cgMLST allele distances;\n")
+	fmt.Fprintf(buf, "!Format DataType=Distance DataFormat=LowerLeft NTaxa=%d;\n\n", len(s.STs))
+	for _, st := range s.STs {
+		buf.WriteString("#" + strings.ReplaceAll(st, " ", "_") + "\n")
+	}
+	buf.WriteByte('\n')
+	for a := range s.STs {
+		fmt.Fprintf(buf, "[%d]", a+1)
+		for b := 0; b < a; b++ {
+			buf.WriteString(" " + matrixValue(s.Distance(a, b), "?"))
+		}
+		buf.WriteByte('\n')
+	}
+	return buf.Flush()
+}
+
+// subsetRequest limits the request to some of its STs, keeping the order they were given in.
+func subsetRequest(request *Request, STs []CgmlstSt) error {
+	requested := make(map[CgmlstSt]bool, len(request.STs))
+	for _, st := range request.STs {
+		requested[st] = true
+	}
+	for _, st := range STs {
+		if !requested[st] {
+			return fmt.Errorf("ST '%s' isn't in the request", st)
+		}
+	}
+	request.STs = STs
+	return nil
+}
+
+// selectSTs narrows the request and the index to the given STs.  In lenient mode the STs without a
+// profile, or with a malformed one, are dropped first and the rejected document is written to
+// rejected.
+func selectSTs(request *Request, index *ProfilesMap, STs []CgmlstSt, rejected io.Writer) (*ProfilesMap, error) {
+	if err := subsetRequest(request, STs); err != nil {
+		return nil, err
+	}
+	if request.Lenient {
+		var output RejectedProfiles
+		request.STs, output = index.Accept(request.STs)
+		if err := json.NewEncoder(rejected).Encode(output); err != nil {
+			return nil, err
+		}
+	}
+	return index.Subset(request.STs)
+}
+
+func runMatrix(args []string) int {
+	var p pipelineFlags
+	flags := newFlagSet("matrix")
+	p.register(flags)
+	format := flags.String("format", "tsv", "output format: tsv (square), phylip (lower triangle) or mega")
+	sts := flags.String("sts", "", "comma separated STs to include (default all of the requested STs)")
+	r, w, code := parseFlags(flags, args, &p.output)
+	if code != EXIT_OK {
+		return code
+	}
+	defer r.Close()
+	defer w.Close()
+	ctx, cancel := p.context()
+	defer cancel()
+
+	var write func(io.Writer, *ScoresStore) error
+	switch *format {
+	case "tsv":
+		write = WriteMatrixTSV
+	case "phylip":
+		write = WritePhylip
+	case "mega":
+		write = WriteMega
+	default:
+		return fail(fmt.Errorf("unknown format '%s'", *format))
+	}
+
+	progress, stopProgress := backgroundProgress(p.verbose)
+	defer stopProgress()
+	opts := p.options()
+	opts.AllDistances = true
+	request, cache, indexer, err := parse(ctx, r, opts.CacheIn, progress)
+	if err != nil {
+		return fail(err)
+	}
+	opts.apply(&request)
+	if *sts != "" {
+		if indexer.index, err = selectSTs(&request, indexer.index, strings.Split(*sts, ","), os.Stderr); err != nil {
+			return fail(err)
+		}
+	}
+	scores, err := runScores(ctx, request, &cache, indexer.index, opts, progress)
+	if err != nil {
+		return fail(err)
+	}
+	if err = write(w, &scores); err != nil {
+		return fail(err)
+	}
+	return EXIT_OK
+}
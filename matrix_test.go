@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"github.com/goccy/go-json"
+	"io"
+	"reflect"
+	"testing"
+)
+
+func TestMatrix(t *testing.T) {
+	progress, stopProgress := backgroundProgress(false)
+	defer stopProgress()
+	request, _, indexer, err := parse(context.Background(), fakeInput(`{"STs": ["A", "B", "C", "D", "E"], "Threshold": 0}`, "{}", fakeProfiles), "", progress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = subsetRequest(&request, []CgmlstSt{"E", "A", "C"}); err != nil {
+		t.Fatal(err)
+	}
+	index, err := indexer.index.Subset(request.STs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	scores, err := runScores(context.Background(), request, NewCache(), index, Options{AllDistances: true}, progress)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		write    func(io.Writer, *ScoresStore) error
+		expected string
+	}{
+		{
+			WriteMatrixTSV,
+			"ST\tE\tA\tC\nE\t0\t3\t1\nA\t3\t0\t3\nC\t1\t3\t0\n",
+		},
+		{
+			WritePhylip,
+			"3\nE         \nA          3\nC          1 3\n",
+		},
+		{
+			WriteMega,
+			"#mega\n!Title: cgMLST allele distances;\n!Format DataType=Distance DataFormat=LowerLeft NTaxa=3;\n\n#E\n#A\n#C\n\n[1]\n[2] 3\n[3] 1 3\n",
+		},
+	} {
+		var output bytes.Buffer
+		if err = test.write(&output, &scores); err != nil {
+			t.Fatal(err)
+		}
+		if output.String() != test.expected {
+			t.Fatalf("Expected %q, got %q", test.expected, output.String())
+		}
+	}
+
+	if err = subsetRequest(&request, []CgmlstSt{"F"}); err == nil {
+		t.Fatal("Expected an error for an ST which wasn't requested")
+	}
+}
+
+func TestMatrixLenientSTs(t *testing.T) {
+	progress, stopProgress := backgroundProgress(false)
+	defer stopProgress()
+	profiles := map[CgmlstSt][]string{"A": fakeProfiles["A"], "B": fakeProfiles["B"], "C": fakeProfiles["C"]}
+	request, _, indexer, err := parse(context.Background(), fakeInput(`{"STs": ["A", "B", "C", "D"], "Threshold": 0}`, "{}", profiles), "", progress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = selectSTs(&request, indexer.index, []CgmlstSt{"D", "A"}, io.Discard); err == nil {
+		t.Fatal("Expected an error for an ST without a profile")
+	}
+
+	request.STs = []CgmlstSt{"A", "B", "C", "D"}
+	request.Lenient = true
+	var rejected bytes.Buffer
+	index, err := selectSTs(&request, indexer.index, []CgmlstSt{"D", "A", "C"}, &rejected)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(request.STs, []CgmlstSt{"A", "C"}) || len(index.lookup) != 2 {
+		t.Fatalf("Expected D to be dropped, got %v", request.STs)
+	}
+	var output RejectedProfiles
+	if err = json.Unmarshal(rejected.Bytes(), &output); err != nil {
+		t.Fatal(err)
+	}
+	if len(output.Rejected) != 1 || output.Rejected[0].ST != "D" || output.Rejected[0].Reason != REJECTED_MISSING {
+		t.Fatalf("Expected D to be rejected, got %v", output.Rejected)
+	}
+}
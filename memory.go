@@ -0,0 +1,216 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// Strategies for clustering within the memory limit
+const (
+	STRATEGY_FULL      = "full"      // keep every distance, which every command and linkage can use
+	STRATEGY_STREAMING = "streaming" // run SLINK as each row is scored and only keep the edges
+)
+
+// Rough sizes used to estimate the memory needed, in bytes
+const (
+	PROFILE_BYTES  = 16 << 10 // an indexed profile of a few thousand loci
+	SCORE_BYTES    = 8        // a distance
+	FLOAT_BYTES    = 8        // a distance copied as a float64 by complete and average linkage or NJ
+	EDGE_BYTES     = 16       // a pair of STs up to the threshold
+	ST_BYTES       = 64       // the name, lookup and output of an ST
+	BASELINE_BYTES = 64 << 20 // the runtime, buffers and the documents being written
+)
+
+// NO_MEMORY_LIMIT turns off the memory check.
+const NO_MEMORY_LIMIT = -1
+
+const MEMORY_LIMIT_USAGE = "refuse or stream runs which would need more memory than this, e.g. 16G, or none (default the cgroup's limit)"
+
+// MemoryPlan is the estimated peak memory of each phase of a run and the strategy which fits
+// under the limit.
+type MemoryPlan struct {
+	STs        int
+	Threshold  int
+	Indexing   int64 // the indexed profiles
+	Scores     int64 // every distance
+	Copy       int64 // the float64 copy of every distance, if the linkage or the tree needs one
+	Clustering int64 // pi, lambda and the row SLINK works on
+	Output     int64 // the edges up to the threshold
+	Rows       int64 // the rows which are being scored at once when streaming
+	Limit      int64 // 0 if there isn't one
+	Strategy   string
+}
+
+// Full is the estimated peak when every distance is kept.
+func (p MemoryPlan) Full() int64 {
+	return BASELINE_BYTES + p.Indexing + p.Scores + p.Copy + p.Clustering + p.Output
+}
+
+// Streaming is the estimated peak when only the edges are kept.
+func (p MemoryPlan) Streaming() int64 {
+	return BASELINE_BYTES + p.Indexing + p.Rows + p.Clustering + p.Output
+}
+
+// estimateMemory works out the size of each phase from the number of STs and the threshold.  The
+// number of edges isn't known until the STs are scored so it assumes each ST has one at each
+// distance up to the threshold.  If copied is true the distances are also copied as float64s.
+func estimateMemory(nSTs int, threshold int, workers int, copied bool) MemoryPlan {
+	if workers <= 0 {
+		workers = runtime.NumCPU() + 1
+	}
+	n := int64(nSTs)
+	pairs := n * (n - 1) / 2
+	edges := n * int64(threshold+1)
+	if edges > pairs {
+		edges = pairs
+	}
+	plan := MemoryPlan{
+		STs:        nSTs,
+		Threshold:  threshold,
+		Indexing:   n * (PROFILE_BYTES + ST_BYTES),
+		Scores:     pairs*SCORE_BYTES + n*4,
+		Clustering: 3 * n * SCORE_BYTES,
+		Output:     edges * EDGE_BYTES,
+		Rows:       2 * int64(workers) * n * SCORE_BYTES,
+	}
+	if copied {
+		plan.Copy = pairs*FLOAT_BYTES + n*FLOAT_BYTES
+	}
+	return plan
+}
+
+// cgroupMemoryLimit reads the memory limit of the container, or returns 0 if there isn't one.
+func cgroupMemoryLimit() int64 {
+	for _, path := range []string{"/sys/fs/cgroup/memory.max", "/sys/fs/cgroup/memory/memory.limit_in_bytes"} {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		value := strings.TrimSpace(string(content))
+		if value == "max" {
+			return 0
+		}
+		limit, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || limit <= 0 || limit >= 1<<60 {
+			// cgroup v1 reports a huge number rather than no limit
+			return 0
+		}
+		return limit
+	}
+	return 0
+}
+
+// parseMemoryLimit reads a size such as 512M or 16G.  "none" turns the check off and "" uses the
+// cgroup's limit.
+func parseMemoryLimit(value string) (int64, error) {
+	value = strings.TrimSpace(value)
+	switch strings.ToLower(value) {
+	case "":
+		return 0, nil
+	case "none":
+		return NO_MEMORY_LIMIT, nil
+	}
+	units := map[byte]int64{'K': 1 << 10, 'M': 1 << 20, 'G': 1 << 30, 'T': 1 << 40}
+	number, multiplier := value, int64(1)
+	if unit, found := units[strings.ToUpper(value)[len(value)-1]]; found {
+		number, multiplier = value[:len(value)-1], unit
+	}
+	size, err := strconv.ParseFloat(number, 64)
+	if err != nil || size <= 0 {
+		return 0, fmt.Errorf("invalid memory limit '%s', expected a size such as 512M or 16G, or none", value)
+	}
+	return int64(size * float64(multiplier)), nil
+}
+
+// memoryLimitFlag is a -memory-limit flag, see parseMemoryLimit.
+type memoryLimitFlag int64
+
+func (f *memoryLimitFlag) String() string {
+	switch {
+	case f == nil || *f == 0:
+		return ""
+	case *f == NO_MEMORY_LIMIT:
+		return "none"
+	}
+	return strconv.FormatInt(int64(*f), 10)
+}
+
+func (f *memoryLimitFlag) Set(value string) error {
+	limit, err := parseMemoryLimit(value)
+	*f = memoryLimitFlag(limit)
+	return err
+}
+
+func formatBytes(n int64) string {
+	switch {
+	case n >= 1<<30:
+		return fmt.Sprintf("%.1f GiB", float64(n)/(1<<30))
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1f MiB", float64(n)/(1<<20))
+	}
+	return fmt.Sprintf("%.1f KiB", float64(n)/(1<<10))
+}
+
+// planMemory estimates the memory needed by the request and checks it against the limit, which is
+// the cgroup's limit unless the options give one.  If every distance doesn't fit and canStream is
+// true the streaming strategy is used if it fits.  Otherwise it fails with INSUFFICIENT_MEMORY
+// before anything big has been allocated.
+func planMemory(request Request, opts Options, canStream bool) (plan MemoryPlan, err error) {
+	linkage, _ := normaliseLinkage(request.Linkage)
+	copied := linkage == COMPLETE_LINKAGE || linkage == AVERAGE_LINKAGE || opts.FloatCopy
+	plan = estimateMemory(len(request.STs), request.Threshold, opts.Workers, copied)
+	plan.Strategy = STRATEGY_FULL
+	switch {
+	case opts.MemoryLimit == NO_MEMORY_LIMIT:
+		return
+	case opts.MemoryLimit > 0:
+		plan.Limit = opts.MemoryLimit
+	default:
+		if plan.Limit = cgroupMemoryLimit(); plan.Limit == 0 {
+			return
+		}
+	}
+
+	if plan.Full() <= plan.Limit {
+		return
+	}
+	if canStream && plan.Streaming() <= plan.Limit {
+		plan.Strategy = STRATEGY_STREAMING
+		log.Printf("Clustering %d STs needs about %s with every distance but the limit is %s, streaming them in about %s instead\n",
+			plan.STs, formatBytes(plan.Full()), formatBytes(plan.Limit), formatBytes(plan.Streaming()))
+		return
+	}
+
+	message := fmt.Sprintf("%d STs need about %s (%s for the profiles, %s for the distances, %s for their float64 copy, %s for the clustering and %s for the edges) but the limit is %s",
+		plan.STs, formatBytes(plan.Full()), formatBytes(plan.Indexing), formatBytes(plan.Scores), formatBytes(plan.Copy), formatBytes(plan.Clustering), formatBytes(plan.Output), formatBytes(plan.Limit))
+	if canStream {
+		message += fmt.Sprintf("; streaming would still need about %s", formatBytes(plan.Streaming()))
+	} else {
+		message += "; only single linkage clusters without summaries, temporal clusters or recommendations can be streamed"
+	}
+	err = &PipelineError{Code: INSUFFICIENT_MEMORY, Phase: PHASE_PLANNING, Message: message}
+	return
+}
+
+// canStream is whether a request can be clustered without keeping every distance, which only
+// single linkage can do.
+func canStream(request Request, opts Options) bool {
+	linkage, err := normaliseLinkage(request.Linkage)
+	return err == nil && linkage == SINGLE_LINKAGE && !request.Summaries && request.Temporal == nil && request.Recommend == nil && !opts.AllDistances
+}
+
+// planRequest returns a check for parseChecked which plans the memory from the number of requested
+// STs as soon as the request has been read, so that a run which can't fit fails before the profiles
+// are indexed.  The memory is planned again once fewer STs might be left to score.  Streaming is
+// only considered if streamable is true.
+func planRequest(opts Options, streamable bool) func(Request) error {
+	return func(request Request) error {
+		opts.apply(&request)
+		_, err := planMemory(request, opts, streamable && canStream(request, opts))
+		return err
+	}
+}
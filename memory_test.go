@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/goccy/go-json"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseMemoryLimit(t *testing.T) {
+	for value, expected := range map[string]int64{
+		"":      0,
+		"none":  NO_MEMORY_LIMIT,
+		"1024":  1024,
+		"512M":  512 << 20,
+		"16g":   16 << 30,
+		"1.5G":  3 << 29,
+		" 2T ":  2 << 40,
+		"100KB": -2,
+		"-1G":   -2,
+		"lots":  -2,
+	} {
+		limit, err := parseMemoryLimit(value)
+		if expected == -2 {
+			if err == nil {
+				t.Fatalf("Expected '%s' to be invalid, got %d", value, limit)
+			}
+		} else if err != nil || limit != expected {
+			t.Fatalf("Expected '%s' to be %d, got %d (%v)", value, expected, limit, err)
+		}
+	}
+}
+
+func TestPlanMemory(t *testing.T) {
+	request := Request{STs: make([]CgmlstSt, 100000), Threshold: 50}
+
+	plan, err := planMemory(request, Options{MemoryLimit: NO_MEMORY_LIMIT}, true)
+	if err != nil || plan.Strategy != STRATEGY_FULL {
+		t.Fatalf("Expected no limit to be checked, got %+v (%v)", plan, err)
+	}
+	if plan.Scores != 100000*99999/2*SCORE_BYTES+100000*4 {
+		t.Fatalf("Unexpected estimate for the scores %d", plan.Scores)
+	}
+
+	opts := Options{MemoryLimit: 16 << 30, Workers: 8}
+	if plan, err = planMemory(request, opts, true); err != nil || plan.Strategy != STRATEGY_STREAMING {
+		t.Fatalf("Expected the run to be streamed, got %+v (%v)", plan, err)
+	}
+	if plan.Streaming() > plan.Limit || plan.Full() <= plan.Limit {
+		t.Fatalf("Expected only streaming to fit, got %+v", plan)
+	}
+
+	_, err = planMemory(request, opts, false)
+	if pipelineErr, ok := err.(*PipelineError); !ok || pipelineErr.Code != INSUFFICIENT_MEMORY || pipelineErr.Phase != PHASE_PLANNING {
+		t.Fatalf("Expected the run to be refused, got %v", err)
+	}
+	if code := exitCode(err); code != 9 {
+		t.Fatalf("Expected exit code 9, got %d", code)
+	}
+
+	opts.MemoryLimit = 1 << 30
+	if _, err = planMemory(request, opts, true); exitCode(err) != exitCodes[INSUFFICIENT_MEMORY] {
+		t.Fatalf("Expected the run to be refused even when streamed, got %v", err)
+	}
+
+	// Complete and average linkage and neighbour-joining copy the distances as float64s
+	request.Linkage = COMPLETE_LINKAGE
+	if plan, _ = planMemory(request, Options{MemoryLimit: NO_MEMORY_LIMIT}, false); plan.Copy != 100000*99999/2*FLOAT_BYTES+100000*FLOAT_BYTES {
+		t.Fatalf("Unexpected estimate for the copy of the distances %d", plan.Copy)
+	}
+	if plan, _ = planMemory(Request{STs: request.STs, Threshold: 50}, Options{MemoryLimit: NO_MEMORY_LIMIT, FloatCopy: true}, false); plan.Copy == 0 {
+		t.Fatal("Expected the copy made for neighbour-joining to be counted")
+	}
+
+	small := Request{STs: []CgmlstSt{"A", "B", "C"}, Threshold: 3}
+	if plan, err = planMemory(small, opts, false); err != nil || plan.Strategy != STRATEGY_FULL {
+		t.Fatalf("Expected a small run to fit, got %+v (%v)", plan, err)
+	}
+}
+
+// collectEdges formats the clustering and gathers the edges at each threshold.
+func collectEdges(output chan ClusterOutput) (edges map[int][][2]int, last ClusterOutput) {
+	edges = make(map[int][][2]int)
+	for doc := range output {
+		for t, pairs := range doc.Edges {
+			edges[t] = pairs
+		}
+		last = doc
+	}
+	return
+}
+
+func TestStreamClustering(t *testing.T) {
+	request := `{"STs": ["A", "B", "C", "D", "E"], "Threshold": 3}`
+	cachedRequest := `{"STs": ["A", "B", "C"], "pi": [1, 2, 2], "lambda": [1, 2, 2147483647], "threshold": 3, "edges": {"1": [[0, 1]], "2": [[1, 2]], "3": [[0, 2]]}}`
+	for _, cache := range []string{"{}", cachedRequest} {
+		progress, stopProgress := backgroundProgress(false)
+		defer stopProgress()
+		parsed, parsedCache, indexer, err := parse(context.Background(), fakeInput(request, cache, fakeProfiles), "", progress)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		scores, err := runScores(context.Background(), parsed, &parsedCache, indexer.index, Options{}, progress)
+		if err != nil {
+			t.Fatal(err)
+		}
+		clusters, _, err := clusterScores(context.Background(), &scores, &parsedCache, parsed.Linkage, progress)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectedEdges, expected := collectEdges(clusters.Format(context.Background(), parsed.Threshold, scores.scores, scores.STs))
+
+		STs, streamed, edges, err := streamClustering(context.Background(), parsed, &parsedCache, indexer.index, 2, progress)
+		if err != nil {
+			t.Fatal(err)
+		}
+		actualEdges, actual := collectEdges(streamed.formatEdges(context.Background(), parsed.Threshold, func(t int) [][2]int { return edges[t] }, STs))
+
+		if !reflect.DeepEqual(STs, scores.STs) {
+			t.Fatalf("Expected the STs %v, got %v", scores.STs, STs)
+		}
+		compareSlices(t, actual.Pi, expected.Pi)
+		compareSlices(t, actual.Lambda, expected.Lambda)
+		if !reflect.DeepEqual(actualEdges, expectedEdges) {
+			t.Fatalf("Expected the edges %v, got %v", expectedEdges, actualEdges)
+		}
+	}
+}
+
+func TestStreamClusteringCancelled(t *testing.T) {
+	progress, stopProgress := backgroundProgress(false)
+	defer stopProgress()
+	request, cache, indexer, err := parse(context.Background(), fakeInput(`{"STs": ["A", "B", "C", "D", "E"], "Threshold": 3}`, "{}", fakeProfiles), "", progress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, _, _, err = streamClustering(ctx, request, &cache, indexer.index, 2, progress); !isCancelled(err) {
+		t.Fatalf("Expected the run to be cancelled, got %v", err)
+	}
+}
+
+func TestPlanBeforeProfiles(t *testing.T) {
+	STs := make([]string, 100000)
+	for i := range STs {
+		STs[i] = fmt.Sprint(i)
+	}
+	request, _ := json.Marshal(Request{STs: STs, Threshold: 50})
+	// The profiles would fail to parse if they were read
+	input := strings.NewReader(string(request) + "\n{}\n}\n")
+	_, _, _, err := _main(context.Background(), input, io.Discard, Options{MemoryLimit: 1 << 30})
+	if pipelineErr, ok := err.(*PipelineError); !ok || pipelineErr.Code != INSUFFICIENT_MEMORY {
+		t.Fatalf("Expected the run to be refused before the profiles were read, got %v", err)
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"math"
+	"time"
+)
+
+const DATE_FORMAT = "2006-01-02"
+
+// Metadata is the optional epidemiological data which can be given with a profile.
+type Metadata struct {
+	Date     string `json:"date,omitempty"` // collection date, YYYY-MM-DD
+	Location string `json:"location,omitempty"`
+	Public   bool   `json:"public,omitempty"`
+}
+
+// date parses the collection date.  Only the date part of a timestamp is used.
+func (m Metadata) date() (time.Time, bool) {
+	if len(m.Date) < len(DATE_FORMAT) {
+		return time.Time{}, false
+	}
+	date, err := time.Parse(DATE_FORMAT, m.Date[:len(DATE_FORMAT)])
+	return date, err == nil
+}
+
+// Filter restricts the request to the profiles whose metadata matches.  Profiles without a date
+// are dropped if From or To are given.
+type Filter struct {
+	Public    bool     // only public profiles
+	Locations []string // only profiles from one of these locations
+	From      string   // only profiles collected on or after this date
+	To        string   // only profiles collected on or before this date
+}
+
+// TemporalRequest asks for the clusters of STs which are linked by pairs within Alleles of each
+// other and collected within Days of each other.
+type TemporalRequest struct {
+	Alleles int
+	Days    int
+}
+
+// TemporalClusters is the output document for a TemporalRequest.  Only clusters of more than one
+// ST are given.
+type TemporalClusters struct {
+	Alleles  int          `json:"alleles"`
+	Days     int          `json:"days"`
+	Clusters [][]CgmlstSt `json:"temporalClusters"`
+}
+
+// Apply returns the STs whose metadata matches the filter, in the same order.
+func (f Filter) Apply(STs []CgmlstSt, metadata map[CgmlstSt]Metadata) ([]CgmlstSt, error) {
+	var from, to time.Time
+	var err error
+	if f.From != "" {
+		if from, err = time.Parse(DATE_FORMAT, f.From); err != nil {
+			return nil, newPipelineError(INVALID_INPUT, "", "invalid filter date '%s'", f.From)
+		}
+	}
+	if f.To != "" {
+		if to, err = time.Parse(DATE_FORMAT, f.To); err != nil {
+			return nil, newPipelineError(INVALID_INPUT, "", "invalid filter date '%s'", f.To)
+		}
+	}
+	locations := make(map[string]bool, len(f.Locations))
+	for _, location := range f.Locations {
+		locations[location] = true
+	}
+
+	kept := make([]CgmlstSt, 0, len(STs))
+	for _, st := range STs {
+		m := metadata[st]
+		if f.Public && !m.Public {
+			continue
+		}
+		if len(locations) > 0 && !locations[m.Location] {
+			continue
+		}
+		if f.From != "" || f.To != "" {
+			date, ok := m.date()
+			if !ok || (f.From != "" && date.Before(from)) || (f.To != "" && date.After(to)) {
+				continue
+			}
+		}
+		kept = append(kept, st)
+	}
+	return kept, nil
+}
+
+// daysApart is the number of days between the collection dates of two STs, or -1 if either of
+// them doesn't have a date.
+func daysApart(a Metadata, b Metadata) int {
+	dateA, okA := a.date()
+	dateB, okB := b.date()
+	if !okA || !okB {
+		return -1
+	}
+	return int(math.Round(math.Abs(dateA.Sub(dateB).Hours()) / 24))
+}
+
+// edgeDays gives the days between the STs of each edge.
+func edgeDays(edges map[int][][2]int, STs []CgmlstSt, metadata map[CgmlstSt]Metadata) map[int][]int {
+	days := make(map[int][]int, len(edges))
+	for distance, pairs := range edges {
+		days[distance] = make([]int, len(pairs))
+		for i, pair := range pairs {
+			days[distance][i] = daysApart(metadata[STs[pair[0]]], metadata[STs[pair[1]]])
+		}
+	}
+	return days
+}
+
+// FindTemporalClusters joins the STs which are within the distance and the number of days of each
+// other.  STs without a date aren't joined to anything.
+func FindTemporalClusters(temporal TemporalRequest, s *ScoresStore, metadata map[CgmlstSt]Metadata) TemporalClusters {
+	parent := make([]int, len(s.STs))
+	for i := range parent {
+		parent[i] = i
+	}
+	find := func(i int) int {
+		for parent[i] != i {
+			parent[i] = parent[parent[i]]
+			i = parent[i]
+		}
+		return i
+	}
+	s.eachPair(temporal.Alleles, func(a, b, distance int) {
+		if days := daysApart(metadata[s.STs[a]], metadata[s.STs[b]]); days >= 0 && days <= temporal.Days {
+			parent[find(a)] = find(b)
+		}
+	})
+
+	members := make(map[int][]CgmlstSt)
+	order := make([]int, 0)
+	for i, st := range s.STs {
+		root := find(i)
+		if _, found := members[root]; !found {
+			order = append(order, root)
+		}
+		members[root] = append(members[root], st)
+	}
+	output := TemporalClusters{temporal.Alleles, temporal.Days, [][]CgmlstSt{}}
+	for _, root := range order {
+		if len(members[root]) > 1 {
+			output.Clusters = append(output.Clusters, members[root])
+		}
+	}
+	return output
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"github.com/goccy/go-json"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMetadata(t *testing.T) {
+	input := strings.Join([]string{
+		`{"STs": ["A", "B", "C", "D", "E"], "Threshold": 2, "TimeEdges": true, "Filter": {"Public": true}, "Temporal": {"Alleles": 1, "Days": 10}}`,
+		`{}`,
+		`{"ST": "A", "Matches": ["1", "1", "1", "1", "1", "1"], "date": "2024-01-01", "public": true}`,
+		`{"ST": "B", "Matches": ["1", "1", "1", "1", "1", "2"], "date": "2024-01-05T12:00:00Z", "public": true}`,
+		`{"ST": "C", "Matches": ["1", "1", "1", "2", "2", "2"], "date": "2024-03-01", "public": true}`,
+		`{"ST": "D", "Matches": ["2", "2", "2", "2", "2", "2"], "public": false}`,
+		`{"ST": "E", "Matches": ["1", "1", "1", "2", "2", "3"], "public": true}`,
+	}, "\n")
+	var output bytes.Buffer
+	STs, _, _, err := _main(context.Background(), strings.NewReader(input), &output, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(STs, []CgmlstSt{"A", "B", "C", "E"}) {
+		t.Fatalf("Expected the private ST to be dropped, got %v", STs)
+	}
+
+	var days map[int][]int
+	var temporal TemporalClusters
+	decoder := json.NewDecoder(&output)
+	for {
+		var doc map[string]json.RawMessage
+		if err := decoder.Decode(&doc); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if raw, found := doc["days"]; found {
+			var d map[int][]int
+			json.Unmarshal(raw, &d)
+			for distance, values := range d {
+				if days == nil {
+					days = make(map[int][]int)
+				}
+				days[distance] = values
+			}
+		}
+		if _, found := doc["temporalClusters"]; found {
+			raw, _ := json.Marshal(doc)
+			json.Unmarshal(raw, &temporal)
+		}
+	}
+
+	// A-B are 1 apart, C-E are 1 apart and B-C are 2 apart
+	expectedDays := map[int][]int{0: {}, 1: {4, -1}, 2: {56}}
+	if !reflect.DeepEqual(days, expectedDays) {
+		t.Fatalf("Expected %v, got %v", expectedDays, days)
+	}
+	expectedTemporal := TemporalClusters{1, 10, [][]CgmlstSt{{"A", "B"}}}
+	if !reflect.DeepEqual(temporal, expectedTemporal) {
+		t.Fatalf("Expected %v, got %v", expectedTemporal, temporal)
+	}
+}
+
+func TestFilter(t *testing.T) {
+	metadata := map[CgmlstSt]Metadata{
+		"A": {Date: "2024-01-01", Location: "UK"},
+		"B": {Date: "2024-02-01", Location: "UK"},
+		"C": {Location: "UK"},
+		"D": {Date: "2024-01-15", Location: "FR"},
+	}
+	STs, err := Filter{Locations: []string{"UK"}, From: "2024-01-01", To: "2024-01-31"}.Apply([]CgmlstSt{"A", "B", "C", "D"}, metadata)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(STs, []CgmlstSt{"A"}) {
+		t.Fatalf("Expected only A, got %v", STs)
+	}
+	if _, err = (Filter{From: "January"}).Apply(STs, metadata); err == nil {
+		t.Fatal("Expected an error for an invalid date")
+	}
+}
+
+func TestFilterWithCache(t *testing.T) {
+	// D is in the cache but is dropped by the filter
+	input := strings.Join([]string{
+		`{"STs": ["A", "B", "C", "D", "E"], "Threshold": 2, "Filter": {"Public": true}}`,
+		`{"STs": ["A", "D"], "pi": [1, 1], "lambda": [2147483647, 2147483647], "edges": {}, "threshold": 2}`,
+		`{"ST": "A", "Matches": ["1", "1", "1", "1", "1", "1"], "public": true}`,
+		`{"ST": "B", "Matches": ["1", "1", "1", "1", "1", "2"], "public": true}`,
+		`{"ST": "C", "Matches": ["1", "1", "1", "2", "2", "2"], "public": true}`,
+		`{"ST": "D", "Matches": ["2", "2", "2", "2", "2", "2"], "public": false}`,
+		`{"ST": "E", "Matches": ["1", "1", "1", "2", "2", "3"], "public": true}`,
+	}, "\n")
+	var output bytes.Buffer
+	STs, _, _, err := _main(context.Background(), strings.NewReader(input), &output, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(STs, []CgmlstSt{"A", "B", "C", "E"}) {
+		t.Fatalf("Expected the cached private ST to be dropped, got %v", STs)
+	}
+}
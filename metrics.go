@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const METRICS_USAGE = "serve Prometheus metrics at /metrics on this address until the command exits, e.g. :9090"
+
+// Metrics are the counters and gauges of every run in the process, gathered from their progress
+// events, so a server's metrics cover all of its requests.  The throughput and utilisation are of
+// the latest scoring phase.
+type Metrics struct {
+	sync.Mutex
+	runsActive       int
+	runs             map[string]int // by the phase the run ended in: done, cancelled or failed
+	profilesParsed   int
+	scoresCalculated int
+	scoresReused     int // from the cache or a checkpoint
+	scoresPerSecond  float64
+	workers          int // scoring workers which are running
+	workerBusy       time.Duration
+	utilisation      float64 // the fraction of the time the scoring workers were busy
+	phaseSeconds     map[string]float64
+	phaseCounts      map[string]int
+	peakMemory       int64
+}
+
+var metrics = NewMetrics()
+
+func NewMetrics() *Metrics {
+	return &Metrics{runs: make(map[string]int), phaseSeconds: make(map[string]float64), phaseCounts: make(map[string]int)}
+}
+
+// runMetrics follows the progress events of one run.
+type runMetrics struct {
+	m       *Metrics
+	now     func() time.Time
+	state   int
+	entered time.Time
+	scored  int
+	workers int
+	busy    time.Duration
+}
+
+func (m *Metrics) newRun(now func() time.Time) *runMetrics {
+	m.Lock()
+	defer m.Unlock()
+	m.runsActive++
+	return &runMetrics{m: m, now: now, entered: now()}
+}
+
+// observe adds an event to the metrics once the progress worker has moved on to state.
+func (r *runMetrics) observe(event ProgressEvent, state int) {
+	m := r.m
+	m.Lock()
+	defer m.Unlock()
+	now := r.now()
+	if state != r.state {
+		if r.state < DONE {
+			phase := statePhases[r.state]
+			m.phaseSeconds[phase] += now.Sub(r.entered).Seconds()
+			m.phaseCounts[phase]++
+		}
+		r.state, r.entered = state, now
+	}
+
+	switch event.EventType {
+	case PROFILE_INDEXED:
+		m.profilesParsed += event.EventValue
+	case CACHED_SCORES_EXPECTED:
+		m.scoresReused += event.EventValue
+	case SCORE_CALCULATED:
+		m.scoresCalculated += event.EventValue
+		r.scored += event.EventValue
+	case WORKERS_STARTED:
+		m.workers += event.EventValue
+		r.workers += event.EventValue
+	case WORKERS_STOPPED:
+		m.workers -= event.EventValue
+	case WORKER_BUSY:
+		m.workerBusy += time.Duration(event.EventValue)
+		r.busy += time.Duration(event.EventValue)
+	case EXIT:
+		m.runsActive--
+		m.runs[statePhases[state]]++
+	}
+
+	if elapsed := now.Sub(r.entered).Seconds(); state == SCORING && elapsed > 0 {
+		m.scoresPerSecond = float64(r.scored) / elapsed
+		if r.workers > 0 {
+			m.utilisation = min(r.busy.Seconds()/(float64(r.workers)*elapsed), 1)
+		}
+	}
+}
+
+// processPeakMemory is the most memory the process has held.  On Linux this is its peak resident
+// set size, elsewhere the most memory the Go runtime has reserved when the metrics were read.
+func processPeakMemory() int64 {
+	if f, err := os.Open("/proc/self/status"); err == nil {
+		defer f.Close()
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			if value, found := strings.CutPrefix(scanner.Text(), "VmHWM:"); found {
+				kB, err := strconv.ParseInt(strings.TrimSuffix(strings.TrimSpace(value), " kB"), 10, 64)
+				if err == nil {
+					return kB * 1024
+				}
+			}
+		}
+	}
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	return int64(stats.Sys)
+}
+
+func writeMetric(w io.Writer, name string, kind string, help string, samples ...string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	for _, sample := range samples {
+		fmt.Fprintln(w, sample)
+	}
+}
+
+func sample(name string, value float64) string {
+	return name + " " + strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// Write writes the metrics in the Prometheus text format.
+func (m *Metrics) Write(w io.Writer) {
+	m.Lock()
+	defer m.Unlock()
+	m.peakMemory = max(m.peakMemory, processPeakMemory())
+
+	writeMetric(w, "clustering_runs_active", "gauge", "Runs in progress.", sample("clustering_runs_active", float64(m.runsActive)))
+	results := make([]string, 0)
+	for _, result := range []string{statePhases[DONE], statePhases[STOPPED], statePhases[FAILED]} {
+		results = append(results, sample(fmt.Sprintf("clustering_runs_total{result=%q}", result), float64(m.runs[result])))
+	}
+	writeMetric(w, "clustering_runs_total", "counter", "Runs which have finished by result.", results...)
+	writeMetric(w, "clustering_profiles_parsed_total", "counter", "cgMLST profiles parsed and indexed.", sample("clustering_profiles_parsed_total", float64(m.profilesParsed)))
+	writeMetric(w, "clustering_scores_calculated_total", "counter", "Distances calculated between pairs of STs.", sample("clustering_scores_calculated_total", float64(m.scoresCalculated)))
+	writeMetric(w, "clustering_scores_reused_total", "counter", "Distances reused from the cache or a checkpoint rather than calculated.", sample("clustering_scores_reused_total", float64(m.scoresReused)))
+	writeMetric(w, "clustering_scores_per_second", "gauge", "Distances calculated per second in the latest scoring phase.", sample("clustering_scores_per_second", m.scoresPerSecond))
+	writeMetric(w, "clustering_workers", "gauge", "Scoring workers which are running.", sample("clustering_workers", float64(m.workers)))
+	writeMetric(w, "clustering_worker_busy_seconds_total", "counter", "Time the scoring workers spent calculating distances.", sample("clustering_worker_busy_seconds_total", m.workerBusy.Seconds()))
+	writeMetric(w, "clustering_worker_utilisation", "gauge", "Fraction of the latest scoring phase the workers were busy.", sample("clustering_worker_utilisation", m.utilisation))
+
+	phases := make([]string, 0, len(m.phaseCounts))
+	for phase := range m.phaseCounts {
+		phases = append(phases, phase)
+	}
+	sort.Strings(phases)
+	durations := make([]string, 0, 2*len(phases))
+	for _, phase := range phases {
+		durations = append(durations,
+			sample(fmt.Sprintf("clustering_phase_duration_seconds_sum{phase=%q}", phase), m.phaseSeconds[phase]),
+			sample(fmt.Sprintf("clustering_phase_duration_seconds_count{phase=%q}", phase), float64(m.phaseCounts[phase])))
+	}
+	writeMetric(w, "clustering_phase_duration_seconds", "summary", "Time the runs spent in each phase.", durations...)
+	writeMetric(w, "clustering_peak_memory_bytes", "gauge", "The most memory the process has held.", sample("clustering_peak_memory_bytes", float64(m.peakMemory)))
+}
+
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.Write(w)
+}
+
+// serveMetrics serves the metrics on addr until stop is called.  A run shouldn't fail because its
+// metrics can't be served, so an error is only logged.
+func serveMetrics(addr string) (stop func()) {
+	if addr == "" {
+		return func() {}
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Printf("Couldn't serve the metrics: %s\n", err)
+		return func() {}
+	}
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", metrics)
+	server := &http.Server{Handler: mux}
+	go server.Serve(listener)
+	log.Printf("Serving metrics on %s\n", listener.Addr())
+	return func() {
+		server.Shutdown(context.Background())
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// metricValues parses the samples written by Metrics.Write.
+func metricValues(t *testing.T, text string) map[string]float64 {
+	values := make(map[string]float64)
+	for _, line := range strings.Split(strings.TrimSpace(text), "\n") {
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, value, found := strings.Cut(line, " ")
+		if !found {
+			t.Fatalf("Malformed sample '%s'", line)
+		}
+		v, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			t.Fatal(err)
+		}
+		values[name] = v
+	}
+	return values
+}
+
+func TestRunMetrics(t *testing.T) {
+	clock := &fakeClock{time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	m := NewMetrics()
+	w := newProgressWorker(clock.now)
+	run := m.newRun(clock.now)
+	send := func(events ...ProgressEvent) {
+		for _, event := range events {
+			w.Update(event)
+			run.observe(event, w.state)
+		}
+	}
+
+	send(ProgressEvent{PROFILES_EXPECTED, 4})
+	clock.advance(time.Second)
+	send(ProgressEvent{PROFILE_INDEXED, 1}, ProgressEvent{PROFILE_INDEXED, 1}, ProgressEvent{PROFILE_INDEXED, 1}, ProgressEvent{PROFILE_INDEXED, 1})
+	clock.advance(2 * time.Second)
+	send(ProgressEvent{SCORES_EXPECTED, 6}, ProgressEvent{CACHED_SCORES_EXPECTED, 1}, ProgressEvent{WORKERS_STARTED, 2})
+	send(ProgressEvent{SCORE_CALCULATED, 2})
+	clock.advance(time.Second)
+	send(ProgressEvent{WORKER_BUSY, int(time.Second)}, ProgressEvent{SCORE_CALCULATED, 3})
+
+	var text bytes.Buffer
+	m.Write(&text)
+	values := metricValues(t, text.String())
+	expected := map[string]float64{
+		"clustering_runs_active":                                    1,
+		"clustering_profiles_parsed_total":                          4,
+		"clustering_scores_calculated_total":                        5,
+		"clustering_scores_reused_total":                            1,
+		"clustering_scores_per_second":                              5,
+		"clustering_workers":                                        2,
+		"clustering_worker_busy_seconds_total":                      1,
+		"clustering_worker_utilisation":                             0.5,
+		`clustering_phase_duration_seconds_sum{phase="starting"}`:   1,
+		`clustering_phase_duration_seconds_sum{phase="indexing"}`:   2,
+		`clustering_phase_duration_seconds_count{phase="indexing"}`: 1,
+		`clustering_runs_total{result="done"}`:                      0,
+	}
+	for name, value := range expected {
+		if values[name] != value {
+			t.Errorf("Expected %s to be %v, got %v", name, value, values[name])
+		}
+	}
+	if values["clustering_peak_memory_bytes"] <= 0 {
+		t.Errorf("Expected the peak memory, got %v", values["clustering_peak_memory_bytes"])
+	}
+
+	send(ProgressEvent{WORKERS_STOPPED, 2}, ProgressEvent{RUN_CANCELLED, 0}, ProgressEvent{EXIT, 0})
+	text.Reset()
+	m.Write(&text)
+	values = metricValues(t, text.String())
+	if values["clustering_runs_active"] != 0 || values["clustering_workers"] != 0 || values[`clustering_runs_total{result="cancelled"}`] != 1 {
+		t.Fatalf("Expected the run to have been cancelled, got\n%s", text.String())
+	}
+	if values[`clustering_phase_duration_seconds_sum{phase="scoring"}`] != 1 {
+		t.Fatalf("Expected the scoring phase to have taken a second, got\n%s", text.String())
+	}
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	scrape := func() map[string]float64 {
+		recorder := httptest.NewRecorder()
+		NewServer(Options{}).Handler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+		if recorder.Code != http.StatusOK || !strings.HasPrefix(recorder.Header().Get("Content-Type"), "text/plain") {
+			t.Fatalf("Expected the metrics, got %d %s", recorder.Code, recorder.Body.String())
+		}
+		return metricValues(t, recorder.Body.String())
+	}
+	before := scrape()
+
+	var output bytes.Buffer
+	if _, _, _, err := _main(context.Background(), fakeInput(sinkRequest, "{}", fakeProfiles), &output, Options{Workers: 2}); err != nil {
+		t.Fatal(err)
+	}
+	after := scrape()
+	increases := map[string]float64{
+		`clustering_runs_total{result="done"}`:                        1,
+		"clustering_profiles_parsed_total":                            5,
+		"clustering_scores_calculated_total":                          10,
+		`clustering_phase_duration_seconds_count{phase="scoring"}`:    1,
+		`clustering_phase_duration_seconds_count{phase="clustering"}`: 1,
+	}
+	for name, increase := range increases {
+		if after[name]-before[name] != increase {
+			t.Errorf("Expected %s to go up by %v, it went from %v to %v", name, increase, before[name], after[name])
+		}
+	}
+}
+
+func TestCommandRunsEnd(t *testing.T) {
+	dir := t.TempDir()
+	input := writeInput(t, filepath.Join(dir, "input.json"), fakeInput(sinkRequest, "{}", fakeProfiles))
+	out := filepath.Join(dir, "out")
+	active := func() int {
+		metrics.Lock()
+		defer metrics.Unlock()
+		return metrics.runsActive
+	}
+
+	before := active()
+	for _, args := range [][]string{{"matrix", "-o", out, input}, {"diff", "-a", "A", "-b", "missing", "-o", out, input}} {
+		commands[args[0]].run(args[1:])
+		if after := active(); after != before {
+			t.Fatalf("Expected %s to end its run, %d runs were active before and %d after", args[0], before, after)
+		}
+	}
+}
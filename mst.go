@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bufio"
+	"encoding/xml"
+	"fmt"
+	"github.com/goccy/go-json"
+	"io"
+	"strings"
+)
+
+// TreeEdge is an edge of the minimum spanning tree.  Source and Target are indexes into the STs.
+type TreeEdge struct {
+	Source   int `json:"source"`
+	Target   int `json:"target"`
+	Distance int `json:"distance"`
+}
+
+// MinimumSpanningTree builds the minimum spanning tree with Prim's algorithm over the condensed
+// distances.  Like MSTreeV2, ties are broken in favour of the profile with the least missing data
+// so that the more complete profiles become the hubs, then by the index of the ST.  Items which
+// couldn't be compared (ALMOST_INF) aren't joined so the result may be a forest.  Edges are given
+// in the order they were added to the tree.
+func MinimumSpanningTree(distances []int, nItems int, missing []int) ([]TreeEdge, error) {
+	if len(distances) != (nItems*(nItems-1))/2 {
+		return nil, fmt.Errorf("Wrong number of distances given")
+	}
+	if len(missing) != nItems {
+		return nil, fmt.Errorf("Expected the missing data of %d STs, got %d", nItems, len(missing))
+	}
+	distance := func(a, b int) int {
+		if a < b {
+			a, b = b, a
+		}
+		return distances[(a*(a-1))/2+b]
+	}
+	// before reports whether item a should be preferred to item b at the same distance
+	before := func(a, b int) bool {
+		if missing[a] != missing[b] {
+			return missing[a] < missing[b]
+		}
+		return a < b
+	}
+
+	inTree := make([]bool, nItems)
+	best := make([]int, nItems)   // the shortest distance to the tree
+	parent := make([]int, nItems) // the item in the tree at that distance
+	for i := range best {
+		best[i] = ALMOST_INF
+		parent[i] = -1
+	}
+
+	edges := make([]TreeEdge, 0, nItems)
+	for added := 0; added < nItems; added++ {
+		next := -1
+		for i := 0; i < nItems; i++ {
+			if inTree[i] {
+				continue
+			}
+			if next < 0 || best[i] < best[next] || (best[i] == best[next] && before(i, next)) {
+				next = i
+			}
+		}
+		inTree[next] = true
+		if parent[next] >= 0 {
+			edges = append(edges, TreeEdge{parent[next], next, best[next]})
+		}
+
+		for i := 0; i < nItems; i++ {
+			if inTree[i] {
+				continue
+			}
+			d := distance(next, i)
+			if d >= ALMOST_INF {
+				continue
+			}
+			if d < best[i] || (d == best[i] && before(next, parent[i])) {
+				best[i] = d
+				parent[i] = next
+			}
+		}
+	}
+	return edges, nil
+}
+
+// missingData counts how many fewer loci each ST has called than the most complete profile.
+func missingData(index *ProfilesMap, STs []CgmlstSt) ([]int, error) {
+	called := make([]int, len(STs))
+	most := 0
+	for i, st := range STs {
+		n, err := index.Called(st)
+		if err != nil {
+			return nil, err
+		}
+		called[i] = n
+		if n > most {
+			most = n
+		}
+	}
+	missing := make([]int, len(STs))
+	for i, n := range called {
+		missing[i] = most - n
+	}
+	return missing, nil
+}
+
+func xmlText(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+// WriteGraphML writes the tree as an undirected GraphML graph which can be opened in Cytoscape or
+// Gephi.  The nodes are labelled with their STs and the edges have a distance attribute.
+func WriteGraphML(w io.Writer, edges []TreeEdge, labels []CgmlstSt, missing []int) error {
+	buf := bufio.NewWriter(w)
+	buf.WriteString(xml.Header)
+	buf.WriteString(`<graphml xmlns="http://graphml.graphdrawing.org/xmlns">` + "\n")
+	buf.WriteString(`  <key id="label" for="node" attr.name="label" attr.type="string"/>` + "\n")
+	buf.WriteString(`  <key id="missing" for="node" attr.name="missing" attr.type="int"/>` + "\n")
+	buf.WriteString(`  <key id="distance" for="edge" attr.name="distance" attr.type="int"/>` + "\n")
+	buf.WriteString(`  <graph id="mst" edgedefault="undirected">` + "\n")
+	for i, label := range labels {
+		fmt.Fprintf(buf, `    <node id="n%d"><data key="label">%s</data><data key="missing">%d</data></node>`+"\n", i, xmlText(label), missing[i])
+	}
+	for i, e := range edges {
+		fmt.Fprintf(buf, `    <edge id="e%d" source="n%d" target="n%d"><data key="distance">%d</data></edge>`+"\n", i, e.Source, e.Target, e.Distance)
+	}
+	buf.WriteString("  </graph>\n</graphml>\n")
+	return buf.Flush()
+}
+
+func runMst(args []string) int {
+	var p pipelineFlags
+	flags := newFlagSet("mst")
+	p.register(flags)
+	format := flags.String("format", "json", "output format: json (edge list) or graphml")
+	r, w, code := parseFlags(flags, args, &p.output)
+	if code != EXIT_OK {
+		return code
+	}
+	defer r.Close()
+	defer w.Close()
+	ctx, cancel := p.context()
+	defer cancel()
+
+	progress, stopProgress := backgroundProgress(p.verbose)
+	defer stopProgress()
+	opts := p.options()
+	opts.AllDistances = true
+	_, _, index, scores, err := scoreInput(ctx, r, opts, progress)
+	if err != nil {
+		return fail(err)
+	}
+	missing, err := missingData(index, scores.STs)
+	if err != nil {
+		return fail(err)
+	}
+	edges, err := MinimumSpanningTree(scores.scores, len(scores.STs), missing)
+	if err != nil {
+		return fail(err)
+	}
+
+	switch *format {
+	case "json":
+		err = json.NewEncoder(w).Encode(struct {
+			STs     []CgmlstSt `json:"STs"`
+			Missing []int      `json:"missing"`
+			Edges   []TreeEdge `json:"edges"`
+		}{scores.STs, missing, edges})
+	case "graphml":
+		err = WriteGraphML(w, edges, scores.STs, missing)
+	default:
+		err = fmt.Errorf("unknown format '%s'", *format)
+	}
+	if err != nil {
+		return fail(err)
+	}
+	return EXIT_OK
+}
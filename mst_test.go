@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMinimumSpanningTree(t *testing.T) {
+	// B is 1 away from A and C, C is 2 away from D and E, D and E can't be compared
+	distances := []int{
+		1,
+		2, 1,
+		3, 3, 2,
+		3, 3, 2, ALMOST_INF,
+	}
+	edges, err := MinimumSpanningTree(distances, 5, []int{0, 0, 0, 0, 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []TreeEdge{{0, 1, 1}, {1, 2, 1}, {2, 3, 2}, {2, 4, 2}}
+	if !reflect.DeepEqual(edges, expected) {
+		t.Fatalf("Expected %v, got %v", expected, edges)
+	}
+
+	// A has the most missing data so C becomes the root and A hangs off B
+	edges, err = MinimumSpanningTree(distances, 5, []int{5, 0, 0, 1, 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = []TreeEdge{{1, 2, 1}, {1, 0, 1}, {2, 3, 2}, {2, 4, 2}}
+	if !reflect.DeepEqual(edges, expected) {
+		t.Fatalf("Expected %v, got %v", expected, edges)
+	}
+
+	var graphml bytes.Buffer
+	if err = WriteGraphML(&graphml, edges, []CgmlstSt{"A", "B", "C", "D", "<E>"}, []int{5, 0, 0, 1, 1}); err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{
+		`<node id="n4"><data key="label">&lt;E&gt;</data><data key="missing">1</data></node>`,
+		`<edge id="e1" source="n1" target="n0"><data key="distance">1</data></edge>`,
+	} {
+		if !strings.Contains(graphml.String(), expected) {
+			t.Fatalf("Expected %s in %s", expected, graphml.String())
+		}
+	}
+}
+
+func TestMinimumSpanningForest(t *testing.T) {
+	edges, err := MinimumSpanningTree([]int{ALMOST_INF, 1, ALMOST_INF}, 3, []int{0, 0, 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []TreeEdge{{0, 2, 1}}
+	if !reflect.DeepEqual(edges, expected) {
+		t.Fatalf("Expected %v, got %v", expected, edges)
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"github.com/goccy/go-json"
+	"io"
+	"strconv"
+)
+
+// NJ_MAX_STS is the default limit on the number of STs for neighbour-joining.  It takes O(n³) time
+// and keeps a second copy of the distances as float64s.
+const NJ_MAX_STS = 5000
+
+// Join is a step of neighbour-joining.  As with Merge, nodes below the number of items are the items
+// themselves and node `nItems + k` is created by the k-th join.  Lengths are the branch lengths from
+// the new node to each of its children.  The last join is the root; it has three children unless
+// there are fewer than three items.
+type Join struct {
+	Children []int     `json:"children"`
+	Lengths  []float64 `json:"lengths"`
+}
+
+// NeighbourJoining builds an unrooted tree from the condensed distances.  A TREE_JOINED event is sent
+// after each join.  Items which couldn't be compared (ALMOST_INF) can't be placed in the tree so
+// they cause an error, as does cancelling the context.
+func NeighbourJoining(ctx context.Context, distances []int, nItems int, progress chan ProgressEvent) ([]Join, error) {
+	if len(distances) != (nItems*(nItems-1))/2 {
+		return nil, fmt.Errorf("Wrong number of distances given")
+	}
+	d := make([]float64, len(distances))
+	for i, distance := range distances {
+		if distance >= ALMOST_INF {
+			return nil, fmt.Errorf("can't build a neighbour-joining tree with STs which couldn't be compared")
+		}
+		d[i] = float64(distance)
+	}
+	idx := func(a, b int) int {
+		if a < b {
+			a, b = b, a
+		}
+		return (a*(a-1))/2 + b
+	}
+
+	joins := make([]Join, 0, nItems)
+	if nItems < 2 {
+		return joins, nil
+	}
+	progress <- ProgressEvent{TREE_STARTED, nItems}
+
+	// Each slot holds a node of the tree, joined nodes take the slot of their first child
+	node := make([]int, nItems)
+	active := make([]int, nItems) // the slots which haven't been joined yet
+	sums := make([]float64, nItems)
+	for i := range node {
+		node[i] = i
+		active[i] = i
+	}
+	for i := 0; i < nItems; i++ {
+		for j := 0; j < i; j++ {
+			sums[i] += d[idx(i, j)]
+			sums[j] += d[idx(i, j)]
+		}
+	}
+
+	for r := nItems; r > 3; r-- {
+		if ctx.Err() != nil {
+			return nil, cancelledError(ctx, PHASE_CLUSTERING)
+		}
+		// Find the pair which minimises Q, keeping the first on a tie
+		bestI, bestJ, bestQ := -1, -1, 0.0
+		for x := 1; x < r; x++ {
+			i := active[x]
+			for _, j := range active[:x] {
+				q := float64(r-2)*d[idx(i, j)] - sums[i] - sums[j]
+				if bestI < 0 || q < bestQ {
+					bestI, bestJ, bestQ = i, j, q
+				}
+			}
+		}
+		i, j := bestI, bestJ
+		dij := d[idx(i, j)]
+		lengthI := dij/2 + (sums[i]-sums[j])/float64(2*(r-2))
+		if lengthI < 0 {
+			lengthI = 0
+		} else if lengthI > dij {
+			lengthI = dij
+		}
+		joins = append(joins, Join{[]int{node[i], node[j]}, []float64{lengthI, dij - lengthI}})
+
+		// The new node takes slot i
+		sums[i] = 0
+		for _, k := range active[:r] {
+			if k == i || k == j {
+				continue
+			}
+			dik, djk := d[idx(i, k)], d[idx(j, k)]
+			duk := (dik + djk - dij) / 2
+			d[idx(i, k)] = duk
+			sums[k] += duk - dik - djk
+			sums[i] += duk
+		}
+		node[i] = nItems + len(joins) - 1
+		for x, k := range active[:r] {
+			if k == j {
+				active[x] = active[r-1]
+				break
+			}
+		}
+		progress <- ProgressEvent{TREE_JOINED, r}
+	}
+
+	if nItems == 2 {
+		dab := d[idx(0, 1)]
+		joins = append(joins, Join{[]int{0, 1}, []float64{dab / 2, dab / 2}})
+	} else {
+		a, b, c := active[0], active[1], active[2]
+		dab, dac, dbc := d[idx(a, b)], d[idx(a, c)], d[idx(b, c)]
+		lengths := []float64{(dab + dac - dbc) / 2, (dab + dbc - dac) / 2, (dac + dbc - dab) / 2}
+		for x := range lengths {
+			if lengths[x] < 0 {
+				lengths[x] = 0
+			}
+		}
+		joins = append(joins, Join{[]int{node[a], node[b], node[c]}, lengths})
+	}
+	progress <- ProgressEvent{TREE_JOINED, 3}
+	return joins, nil
+}
+
+// WriteJoinsNewick writes the neighbour-joining tree as Newick with the last join as its root.
+func WriteJoinsNewick(w io.Writer, joins []Join, labels []CgmlstSt) error {
+	nItems := len(labels)
+	buf := bufio.NewWriter(w)
+	if len(joins) == 0 {
+		if nItems > 0 {
+			buf.WriteString(newickLabel(labels[0]))
+		}
+		buf.WriteString(";\n")
+		return buf.Flush()
+	}
+
+	type frame struct {
+		node   int
+		length float64
+		next   int
+	}
+	stack := []frame{{nItems + len(joins) - 1, 0, 0}}
+	for len(stack) > 0 {
+		top := &stack[len(stack)-1]
+		if top.node < nItems {
+			buf.WriteString(newickLabel(labels[top.node]))
+		} else if join := joins[top.node-nItems]; top.next < len(join.Children) {
+			if top.next == 0 {
+				buf.WriteByte('(')
+			} else {
+				buf.WriteByte(',')
+			}
+			child := frame{join.Children[top.next], join.Lengths[top.next], 0}
+			top.next++
+			stack = append(stack, child)
+			continue
+		} else {
+			buf.WriteByte(')')
+		}
+		if len(stack) > 1 {
+			buf.WriteByte(':')
+			buf.WriteString(strconv.FormatFloat(top.length, 'f', -1, 64))
+		}
+		stack = stack[:len(stack)-1]
+	}
+	buf.WriteString(";\n")
+	return buf.Flush()
+}
+
+func runNj(args []string) int {
+	var p pipelineFlags
+	flags := newFlagSet("nj")
+	p.register(flags)
+	format := flags.String("format", "newick", "output format: newick or json (list of joins)")
+	maxSTs := flags.Int("max-sts", NJ_MAX_STS, "refuse to build a tree of more STs than this")
+	r, w, code := parseFlags(flags, args, &p.output)
+	if code != EXIT_OK {
+		return code
+	}
+	defer r.Close()
+	defer w.Close()
+	ctx, cancel := p.context()
+	defer cancel()
+
+	progress, stopProgress := backgroundProgress(p.verbose)
+	defer stopProgress()
+	opts := p.options()
+	opts.AllDistances = true
+	opts.FloatCopy = true
+	request, cache, indexer, err := parseChecked(ctx, r, opts.CacheIn, planRequest(opts, false), progress)
+	if err != nil {
+		return fail(err)
+	}
+	if len(request.STs) > *maxSTs {
+		return fail(fmt.Errorf("%d STs is more than the limit of %d for neighbour-joining", len(request.STs), *maxSTs))
+	}
+	opts.apply(&request)
+	scores, err := runScores(ctx, request, &cache, indexer.index, opts, progress)
+	if err != nil {
+		return fail(err)
+	}
+
+	joins, err := NeighbourJoining(ctx, scores.scores, len(scores.STs), progress)
+	if err != nil {
+		return fail(err)
+	}
+	switch *format {
+	case "newick":
+		err = WriteJoinsNewick(w, joins, scores.STs)
+	case "json":
+		err = json.NewEncoder(w).Encode(struct {
+			STs   []CgmlstSt `json:"STs"`
+			Joins []Join     `json:"joins"`
+		}{scores.STs, joins})
+	default:
+		err = fmt.Errorf("unknown format '%s'", *format)
+	}
+	if err != nil {
+		return fail(err)
+	}
+	return EXIT_OK
+}
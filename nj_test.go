@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"testing"
+)
+
+// leafDistances adds up the branch lengths between each pair of leaves of the tree.
+func leafDistances(joins []Join, nItems int) [][]float64 {
+	parent := make([]int, nItems+len(joins))
+	length := make([]float64, nItems+len(joins))
+	for i := range parent {
+		parent[i] = -1
+	}
+	for k, join := range joins {
+		for c, child := range join.Children {
+			parent[child] = nItems + k
+			length[child] = join.Lengths[c]
+		}
+	}
+	toRoot := func(n int) map[int]float64 {
+		ancestors := map[int]float64{n: 0}
+		total := 0.0
+		for ; parent[n] >= 0; n = parent[n] {
+			total += length[n]
+			ancestors[parent[n]] = total
+		}
+		return ancestors
+	}
+	distances := make([][]float64, nItems)
+	for a := 0; a < nItems; a++ {
+		distances[a] = make([]float64, nItems)
+		fromA := toRoot(a)
+		for b := 0; b < nItems; b++ {
+			total := 0.0
+			for n := b; ; n = parent[n] {
+				if up, found := fromA[n]; found {
+					distances[a][b] = total + up
+					break
+				}
+				total += length[n]
+			}
+		}
+	}
+	return distances
+}
+
+func TestNeighbourJoining(t *testing.T) {
+	// The distances are additive so the tree should reproduce them
+	distances := []int{
+		5,
+		9, 10,
+		9, 10, 8,
+		8, 9, 7, 3,
+	}
+	progress, stopProgress := backgroundProgress(false)
+	defer stopProgress()
+	joins, err := NeighbourJoining(context.Background(), distances, 5, progress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(joins) != 3 || len(joins[2].Children) != 3 {
+		t.Fatalf("Expected two joins and a root with three children, got %v", joins)
+	}
+	actual := leafDistances(joins, 5)
+	for a := 1; a < 5; a++ {
+		for b := 0; b < a; b++ {
+			if expected := float64(distances[(a*(a-1))/2+b]); actual[a][b] != expected {
+				t.Fatalf("Expected %d and %d to be %v apart, got %v", a, b, expected, actual[a][b])
+			}
+		}
+	}
+
+	var newick bytes.Buffer
+	if err = WriteJoinsNewick(&newick, joins[:0], []CgmlstSt{"A"}); err != nil {
+		t.Fatal(err)
+	}
+	if newick.String() != "A;\n" {
+		t.Fatalf("Unexpected tree %s", newick.String())
+	}
+	newick.Reset()
+	joins, _ = NeighbourJoining(context.Background(), []int{1, 2, 2}, 3, progress)
+	if err = WriteJoinsNewick(&newick, joins, []CgmlstSt{"A", "B", "C"}); err != nil {
+		t.Fatal(err)
+	}
+	if expected := "(A:0.5,B:0.5,C:1.5);\n"; newick.String() != expected {
+		t.Fatalf("Expected %s, got %s", expected, newick.String())
+	}
+
+	if _, err = NeighbourJoining(context.Background(), []int{1, ALMOST_INF, 2}, 3, progress); err == nil {
+		t.Fatal("Expected an error for STs which couldn't be compared")
+	}
+}
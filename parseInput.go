@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"github.com/goccy/go-json"
 	"io"
 	"sync"
@@ -9,8 +10,17 @@ import (
 type CgmlstSt = string
 
 type Request struct {
-	STs       []CgmlstSt
-	Threshold int
+	STs        []CgmlstSt
+	Threshold  int
+	Linkage    string            // single (default), complete or average
+	Summaries  bool              // also send a summary of the clusters at each threshold
+	Filter     *Filter           // only cluster the STs whose profiles match
+	TimeEdges  bool              // give the days between the STs of each edge
+	Temporal   *TemporalRequest  // also send the clusters which are close in time as well as distance
+	Lenient    bool              // drop the STs whose profiles are missing or malformed rather than failing
+	Duplicates string            // what to do if an ST has conflicting profiles: first (default), strict or majority
+	QC         *QCLimits         // send the QC table and exclude the profiles outside the limits
+	Recommend  *RecommendRequest // also send the distribution of the distances and suggested thresholds
 }
 
 type Cache struct {
@@ -19,6 +29,7 @@ type Cache struct {
 	Lambda    []int
 	Sts       []string
 	Threshold int
+	Linkage   string // the linkage used to calculate pi and lambda, single if empty
 	nEdges    int
 	sync.RWMutex
 }
@@ -29,21 +40,54 @@ func NewCache() *Cache {
 }
 
 type Profile struct {
-	ST         CgmlstSt
-	Matches    []string
+	ST      CgmlstSt
+	Matches []string
+	Metadata
 	schemeSize uint32
 }
 
-func indexProfile(profile *Profile, index *Indexer, progress chan ProgressEvent) {
-	duplicate, profileErr := index.Index(profile)
+func indexProfile(profile *Profile, index func(*Profile) (bool, error), progress chan ProgressEvent) error {
+	duplicate, profileErr := index(profile)
 	if profileErr == nil && !duplicate {
-		progress <- ProgressEvent{PROFILE_PARSED, 1}
+		progress <- ProgressEvent{PROFILE_INDEXED, 1}
 	}
+	return profileErr
+}
+
+// parse reads the request, the cache and the profiles.  If cachePath is empty the cache is expected
+// to be the second document in r, otherwise it is read from that file and r only holds the request
+// followed by the profiles.
+func parse(ctx context.Context, r io.Reader, cachePath string, progress chan ProgressEvent) (request Request, cache Cache, indexer *Indexer, err error) {
+	return parseChecked(ctx, r, cachePath, nil, progress)
 }
 
-func parse(r io.Reader, progress chan ProgressEvent) (request Request, cache Cache, index *ProfilesMap, err error) {
-	err = nil
+// parseChecked is parse with a check of the request, such as planRequest, which is made before the
+// profiles are read.
+func parseChecked(ctx context.Context, r io.Reader, cachePath string, check func(Request) error, progress chan ProgressEvent) (request Request, cache Cache, indexer *Indexer, err error) {
 	decoder := json.NewDecoder(r)
+	if request, cache, err = parseRequest(decoder, cachePath, progress); err != nil {
+		return
+	}
+	if check != nil {
+		if err = check(request); err != nil {
+			return
+		}
+	}
+
+	indexer = NewIndexer(request.STs)
+	indexer.CheckDuplicates()
+	// The request might only be made lenient by a flag, so the rejections are always recorded and
+	// a strict run fails in Complete if a requested profile was malformed
+	if err = parseProfiles(ctx, decoder, indexer.Index, indexer.index.reject, progress); err != nil {
+		return
+	}
+	err = indexer.ResolveDuplicates(request.Duplicates)
+	return
+}
+
+// parseRequest reads the request and the cache documents.  If a cache path is given the cache is
+// read from that file instead of the decoder.
+func parseRequest(decoder *json.Decoder, cachePath string, progress chan ProgressEvent) (request Request, cache Cache, err error) {
 	if requestErr := decoder.Decode(&request); requestErr != nil {
 		err = requestErr
 		return
@@ -51,25 +95,47 @@ func parse(r io.Reader, progress chan ProgressEvent) (request Request, cache Cac
 
 	progress <- ProgressEvent{PROFILES_EXPECTED, len(request.STs)}
 
-	if cacheErr := decoder.Decode(&cache); cacheErr != nil {
+	if cachePath != "" {
+		if cache, err = ReadCacheFile(cachePath); err != nil {
+			return
+		}
+	} else if cacheErr := decoder.Decode(&cache); cacheErr != nil {
 		err = cacheErr
 		return
 	}
+	progress <- ProgressEvent{CACHE_DOC_PARSED, 0}
+	return
+}
 
-	var indexer = NewIndexer(request.STs)
-
+// parseProfiles indexes each of the remaining documents.  If reject isn't nil it is given the
+// profiles which can't be read or indexed.  Appending and adding profiles to a server pass nil, so
+// a profile which can't be read is an error and one which can't be indexed is ignored.  It stops
+// with an error if the context is cancelled.
+func parseProfiles(ctx context.Context, decoder *json.Decoder, index func(*Profile) (bool, error), reject func(Rejection), progress chan ProgressEvent) error {
 	for {
-		var profile Profile
-		if profileErr := decoder.Decode(&profile); profileErr != nil {
+		if ctx.Err() != nil {
+			return cancelledError(ctx, PHASE_PARSING)
+		}
+		// Decode each document separately so that the stream can be read past a malformed profile
+		var raw json.RawMessage
+		if profileErr := decoder.Decode(&raw); profileErr != nil {
 			if profileErr == io.EOF {
-				break
+				return nil
 			}
-			err = profileErr
-			return
+			return profileErr
+		}
+		var profile Profile
+		if profileErr := json.Unmarshal(raw, &profile); profileErr != nil {
+			if reject == nil {
+				return profileErr
+			}
+			var id struct{ ST CgmlstSt }
+			_ = json.Unmarshal(raw, &id)
+			reject(Rejection{id.ST, REJECTED_MALFORMED, profileErr.Error()})
+			continue
+		}
+		if profileErr := indexProfile(&profile, index, progress); profileErr != nil && reject != nil {
+			reject(Rejection{profile.ST, REJECTED_UNREQUESTED, profileErr.Error()})
 		}
-		indexProfile(&profile, indexer, progress)
 	}
-	index = indexer.index
-
-	return
 }
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"sync"
 	"time"
 )
 
@@ -11,11 +12,20 @@ const (
 	CACHED_SCORES_EXPECTED = iota
 	PROFILE_PARSED         = iota
 	PROFILE_INDEXED        = iota
+	SCORES_EXPECTED        = iota
 	SCORE_CALCULATED       = iota
 	DISTANCES_STARTED      = iota
 	CLUSTERING_STARTED     = iota
+	STS_CLUSTERED          = iota
 	RESULTS_TO_SAVE        = iota
 	SAVED_RESULT           = iota
+	TREE_STARTED           = iota
+	TREE_JOINED            = iota
+	WORKERS_STARTED        = iota
+	WORKERS_STOPPED        = iota
+	WORKER_BUSY            = iota // the nanoseconds a worker took to score a row
+	RUN_CANCELLED          = iota
+	RUN_FAILED             = iota
 	EXIT                   = iota
 )
 
@@ -27,8 +37,11 @@ const (
 	INDEXING_PROFILES = iota
 	SCORING           = iota
 	CLUSTERING        = iota
+	BUILDING_TREE     = iota
 	SAVING_RESULTS    = iota
 	DONE              = iota
+	STOPPED           = iota
+	FAILED            = iota
 )
 
 type ProgressEvent struct {
@@ -36,121 +49,273 @@ type ProgressEvent struct {
 	EventValue int
 }
 
+// ProgressMessage is the progress of the whole run and of the phase it's in.  Done and Total count
+// the items of the phase: profiles, pairs of STs, STs, pairs considered by the neighbour-joining
+// steps or output documents.  Elapsed and ETA are in seconds.
 type ProgressMessage struct {
 	Message  string  `json:"message"`
 	Progress float32 `json:"progress"`
+	Phase    string  `json:"phase"`
+	Done     int     `json:"done"`
+	Total    int     `json:"total"`
+	Elapsed  float64 `json:"elapsed"`
+	ETA      float64 `json:"eta"`
+}
+
+var stateMessages = map[int]string{
+	STARTING:          "Initialising",
+	PARSING_CACHE:     "Loading data from the cache",
+	PARSING_PROFILES:  "Parsing cgMLST profiles",
+	INDEXING_PROFILES: "Indexing cgMLST profiles",
+	SCORING:           "Calculating pairwise distances",
+	CLUSTERING:        "Single-linkage clustering",
+	BUILDING_TREE:     "Neighbour-joining",
+	SAVING_RESULTS:    "Saving results",
+	DONE:              "Clustering complete",
+	STOPPED:           "Cancelled",
+	FAILED:            "Failed",
+}
+
+var statePhases = map[int]string{
+	STARTING:          "starting",
+	PARSING_CACHE:     PHASE_PARSING,
+	PARSING_PROFILES:  PHASE_PARSING,
+	INDEXING_PROFILES: "indexing",
+	SCORING:           PHASE_SCORING,
+	CLUSTERING:        PHASE_CLUSTERING,
+	BUILDING_TREE:     "tree",
+	SAVING_RESULTS:    PHASE_OUTPUT,
+	DONE:              "done",
+	STOPPED:           "cancelled",
+	FAILED:            "failed",
+}
+
+// defaultCosts are the seconds an item of each phase is expected to take until the phase has
+// started and its throughput can be measured.
+var defaultCosts = map[int]float64{
+	INDEXING_PROFILES: 250e-6, // a profile
+	SCORING:           500e-9, // a pair of STs
+	CLUSTERING:        2e-6,   // an ST
+	BUILDING_TREE:     5e-9,   // a pair considered by a neighbour-joining step
+	SAVING_RESULTS:    10e-3,  // a document
+}
+
+// joinWork is the work of the neighbour-joining step with r nodes left.
+func joinWork(r int) int {
+	if r <= 3 {
+		return 0
+	}
+	return (r * (r - 1)) / 2
+}
+
+// phase counts the items of a state of the run and the time it took.
+type phase struct {
+	done, total int
+	started     time.Time
+	spent       time.Duration // only set once the run has moved on to a later state
 }
 
 type ProgressWorker struct {
 	lastProgress float32
-	totalWork    int
-	workDone     int
+	reported     float32 // the highest progress given so far, so that it doesn't go backwards
 	state        int
-	cachingCost  int
+	started      time.Time
+	phases       map[int]*phase
+	now          func() time.Time
 }
 
-// Somewhat realistic relative costs
-const (
-	PARSE_COST = 46000
-	// INDEX_COST   = 16000
-	SCORE_COST   = 22
-	CACHING_COST = SCORE_COST / 5
-)
+func newProgressWorker(now func() time.Time) *ProgressWorker {
+	w := &ProgressWorker{started: now(), now: now, phases: make(map[int]*phase)}
+	for state := range defaultCosts {
+		w.phases[state] = &phase{}
+	}
+	return w
+}
+
+// enter moves on to a later state.  The time spent in the previous state is kept so that its
+// throughput is known.
+func (w *ProgressWorker) enter(state int) {
+	if state <= w.state {
+		return
+	}
+	now := w.now()
+	if previous, found := w.phases[w.state]; found {
+		previous.spent = now.Sub(previous.started)
+	}
+	w.state = state
+	if next, found := w.phases[state]; found {
+		next.started = now
+	}
+}
 
 func (w *ProgressWorker) Update(msg ProgressEvent) {
+	if w.state >= DONE && msg.EventType != EXIT {
+		return
+	}
 	switch msg.EventType {
 	case PROFILES_EXPECTED:
+		// The first estimate of each phase, which is refined once it starts
 		nSts := msg.EventValue
-		nScores := (nSts * (nSts - 1)) / 2
-		w.totalWork = (PARSE_COST) * nSts
-		w.totalWork += (SCORE_COST + w.cachingCost) * nScores
+		w.phases[INDEXING_PROFILES].total = nSts
+		w.phases[SCORING].total = (nSts * (nSts - 1)) / 2
+		w.phases[CLUSTERING].total = nSts
 	case CACHE_DOC_PARSED:
-		if w.state < PARSING_CACHE {
-			w.state = PARSING_CACHE
-		}
+		w.enter(PARSING_CACHE)
 	case PROFILE_PARSED:
-		if w.state < PARSING_PROFILES {
-			w.state = PARSING_PROFILES
-		} else if w.state > SAVING_RESULTS {
-			return
-		}
-		w.workDone += PARSE_COST
+		w.enter(PARSING_PROFILES)
+	case PROFILE_INDEXED:
+		w.enter(INDEXING_PROFILES)
+		w.phases[INDEXING_PROFILES].done += msg.EventValue
+	case SCORES_EXPECTED:
+		w.phases[SCORING].total = msg.EventValue
 	case CACHED_SCORES_EXPECTED:
-		newTotal := w.totalWork - (msg.EventValue * SCORE_COST)
-		w.workDone = w.workDone * newTotal / w.totalWork
-		w.totalWork = newTotal
+		w.phases[SCORING].total = max(w.phases[SCORING].total-msg.EventValue, 0)
 	case SCORE_CALCULATED:
-		if w.state < SCORING {
-			w.state = SCORING
-		} else if w.state > SAVING_RESULTS {
-			return
+		w.enter(SCORING)
+		w.phases[SCORING].done += msg.EventValue
+	case CLUSTERING_STARTED:
+		w.enter(CLUSTERING)
+		w.phases[CLUSTERING].total = msg.EventValue
+	case STS_CLUSTERED:
+		w.enter(CLUSTERING)
+		w.phases[CLUSTERING].done += msg.EventValue
+	case TREE_STARTED:
+		w.enter(BUILDING_TREE)
+		for r := msg.EventValue; r > 3; r-- {
+			w.phases[BUILDING_TREE].total += joinWork(r)
 		}
-		w.workDone += SCORE_COST
+	case TREE_JOINED:
+		w.enter(BUILDING_TREE)
+		w.phases[BUILDING_TREE].done += joinWork(msg.EventValue)
 	case RESULTS_TO_SAVE:
-		if w.state < SAVING_RESULTS {
-			w.state = SAVING_RESULTS
-		}
-		w.cachingCost = (w.totalWork - w.workDone) / msg.EventValue
+		w.enter(SAVING_RESULTS)
+		w.phases[SAVING_RESULTS].total = msg.EventValue
 	case SAVED_RESULT:
-		if w.state < SAVING_RESULTS {
-			w.state = SAVING_RESULTS
-		}
-		w.workDone += w.cachingCost
+		w.enter(SAVING_RESULTS)
+		w.phases[SAVING_RESULTS].done += msg.EventValue
+	case RUN_CANCELLED:
+		w.enter(STOPPED)
+	case RUN_FAILED:
+		w.enter(FAILED)
 	case EXIT:
-		if w.state < DONE {
-			w.state = DONE
-		}
+		w.enter(DONE)
 	default:
 	}
 }
 
+// cost is the measured time of an item of the phase, or its default cost if it hasn't started.
+func (w *ProgressWorker) cost(state int, now time.Time) float64 {
+	p := w.phases[state]
+	spent := p.spent
+	if state == w.state {
+		spent = now.Sub(p.started)
+	}
+	if p.done > 0 && spent > 0 {
+		return spent.Seconds() / float64(p.done)
+	}
+	return defaultCosts[state]
+}
+
+// remaining estimates the seconds left in the current and later phases.
+func (w *ProgressWorker) remaining(now time.Time) float64 {
+	var seconds float64
+	for state := max(w.state, INDEXING_PROFILES); state < DONE; state++ {
+		p, found := w.phases[state]
+		if !found || p.done >= p.total {
+			continue
+		}
+		seconds += float64(p.total-p.done) * w.cost(state, now)
+	}
+	return seconds
+}
+
+// Progress estimates how far through the run is from the throughput of each phase so far.  It
+// never goes backwards and only reaches 100% once the run is done.
 func (w *ProgressWorker) Progress() ProgressMessage {
-	if w.totalWork == 0 {
-		return ProgressMessage{"Initialising", 0}
+	now := w.now()
+	message := ProgressMessage{
+		Message: stateMessages[w.state],
+		Phase:   statePhases[w.state],
+		Elapsed: now.Sub(w.started).Seconds(),
 	}
-	progress := 100.0 * (float32(w.workDone) / float32(w.totalWork))
-	if progress > 99.999 {
-		progress = 99.999
+	if p, found := w.phases[w.state]; found {
+		message.Done, message.Total = p.done, p.total
 	}
-	var message string
 	switch w.state {
-	case STARTING:
-		message = "Initialising"
-	case PARSING_CACHE:
-		message = "Loading data from the cache"
-	case PARSING_PROFILES:
-		message = "Parsing CGMLST profilesMap"
-	case INDEXING_PROFILES:
-		message = "Indexing CGMLST profilesMap"
-	case SCORING:
-		message = "Calculating pairwise distances"
-	case CLUSTERING:
-		message = "Single-linkage clustering"
-	case SAVING_RESULTS:
-		message = "Saving results"
 	case DONE:
-		message = "Clustering complete"
+		message.Progress = 100
+		return message
+	case STOPPED, FAILED:
+		message.Progress = w.reported
+		return message
+	}
+
+	message.ETA = w.remaining(now)
+	if total := message.Elapsed + message.ETA; total > 0 {
+		message.Progress = float32(100 * message.Elapsed / total)
+	}
+	if message.Progress > 99.999 {
+		message.Progress = 99.999
 	}
-	return ProgressMessage{message, progress}
+	if message.Progress < w.reported {
+		message.Progress = w.reported
+	}
+	w.reported = message.Progress
+	return message
 }
 
+// NewProgressWorker returns a channel for progress events and a channel of progress messages.  The
+// worker stops and closes the messages once it receives an EXIT event, after a final 100% message if
+// the run wasn't cancelled and didn't fail.  RUN_CANCELLED and RUN_FAILED events are passed on
+// straight away.  The events are also added to the metrics.
 func NewProgressWorker() (chan ProgressEvent, chan ProgressMessage) {
-	worker := ProgressWorker{cachingCost: CACHING_COST}
+	worker := newProgressWorker(time.Now)
+	run := metrics.newRun(time.Now)
 	input := make(chan ProgressEvent, 1000)
 	output := make(chan ProgressMessage, 1000)
+	stop := make(chan bool)
+	var mu sync.Mutex
 
 	go func() {
+		defer close(stop)
 		for msg := range input {
+			mu.Lock()
 			worker.Update(msg)
+			run.observe(msg, worker.state)
+			switch msg.EventType {
+			case RUN_CANCELLED, RUN_FAILED:
+				output <- worker.Progress()
+			case EXIT:
+				if worker.state == DONE {
+					output <- worker.Progress()
+				}
+			}
+			mu.Unlock()
+			if msg.EventType == EXIT {
+				return
+			}
 		}
 	}()
 
-	tick := time.Tick(time.Second)
+	ticker := time.NewTicker(time.Second)
 
 	go func() {
+		defer close(output)
+		defer ticker.Stop()
 		for {
-			<-tick
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+			mu.Lock()
+			if worker.state >= DONE {
+				// The last message has already been sent
+				mu.Unlock()
+				continue
+			}
 			p := worker.Progress()
+			mu.Unlock()
 			if p.Progress > worker.lastProgress+0.1 {
 				output <- p
 				worker.lastProgress = p.Progress
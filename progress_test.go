@@ -0,0 +1,183 @@
+package main
+
+import (
+	"math"
+	"syscall"
+	"testing"
+	"time"
+)
+
+type fakeClock struct {
+	t time.Time
+}
+
+func (c *fakeClock) now() time.Time {
+	return c.t
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.t = c.t.Add(d)
+}
+
+func closeTo(a float64, b float64) bool {
+	return math.Abs(a-b) < 1e-6
+}
+
+func TestProgressPhases(t *testing.T) {
+	clock := &fakeClock{time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	w := newProgressWorker(clock.now)
+
+	w.Update(ProgressEvent{PROFILES_EXPECTED, 100})
+	p := w.Progress()
+	expected := 100*defaultCosts[INDEXING_PROFILES] + 4950*defaultCosts[SCORING] + 100*defaultCosts[CLUSTERING]
+	if p.Phase != "starting" || p.Elapsed != 0 || !closeTo(p.ETA, expected) {
+		t.Fatalf("Expected an estimate from the default costs, got %+v", p)
+	}
+
+	w.Update(ProgressEvent{CACHE_DOC_PARSED, 0})
+	clock.advance(time.Second)
+	for i := 0; i < 50; i++ {
+		w.Update(ProgressEvent{PROFILE_INDEXED, 1})
+	}
+	clock.advance(time.Second)
+	p = w.Progress()
+	// 50 profiles took a second so the other 50 should take another
+	expected = 1 + 4950*defaultCosts[SCORING] + 100*defaultCosts[CLUSTERING]
+	if p.Phase != "indexing" || p.Message != "Indexing cgMLST profiles" || p.Done != 50 || p.Total != 100 || p.Elapsed != 2 || !closeTo(p.ETA, expected) {
+		t.Fatalf("Expected the indexing throughput to be measured, got %+v", p)
+	}
+	if math.Abs(float64(p.Progress)-100*2/(2+expected)) > 1e-3 {
+		t.Fatalf("Expected the progress to be the fraction of the estimated time, got %f", p.Progress)
+	}
+
+	for i := 0; i < 50; i++ {
+		w.Update(ProgressEvent{PROFILE_INDEXED, 1})
+	}
+	w.Update(ProgressEvent{SCORES_EXPECTED, 4950})
+	w.Update(ProgressEvent{CACHED_SCORES_EXPECTED, 950})
+	w.Update(ProgressEvent{SCORE_CALCULATED, 1000})
+	clock.advance(2 * time.Second)
+	p = w.Progress()
+	if p.Phase != "scoring" || p.Done != 1000 || p.Total != 4000 || !closeTo(p.ETA, 6+100*defaultCosts[CLUSTERING]) {
+		t.Fatalf("Expected the scoring throughput to be measured, got %+v", p)
+	}
+
+	// The scores slow down, which mustn't make the progress go backwards
+	before := p.Progress
+	clock.advance(20 * time.Second)
+	w.Update(ProgressEvent{SCORE_CALCULATED, 10})
+	if p = w.Progress(); p.Progress != before {
+		t.Fatalf("Expected the progress to stay at %f, got %f", before, p.Progress)
+	}
+
+	w.Update(ProgressEvent{SCORE_CALCULATED, 2990})
+	w.Update(ProgressEvent{CLUSTERING_STARTED, 100})
+	w.Update(ProgressEvent{STS_CLUSTERED, 25})
+	clock.advance(time.Second)
+	p = w.Progress()
+	if p.Phase != "clustering" || p.Message != "Single-linkage clustering" || p.Done != 25 || p.Total != 100 || !closeTo(p.ETA, 3) {
+		t.Fatalf("Expected the clustering phase, got %+v", p)
+	}
+
+	w.Update(ProgressEvent{STS_CLUSTERED, 75})
+	w.Update(ProgressEvent{RESULTS_TO_SAVE, 4})
+	w.Update(ProgressEvent{SAVED_RESULT, 1})
+	p = w.Progress()
+	if p.Phase != PHASE_OUTPUT || p.Done != 1 || p.Total != 4 || p.Progress >= 100 {
+		t.Fatalf("Expected the output phase, got %+v", p)
+	}
+
+	w.Update(ProgressEvent{EXIT, 0})
+	if p = w.Progress(); p.Phase != "done" || p.Progress != 100 || p.ETA != 0 || p.Elapsed != 25 {
+		t.Fatalf("Expected the run to be complete, got %+v", p)
+	}
+}
+
+func TestProgressTree(t *testing.T) {
+	clock := &fakeClock{time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	w := newProgressWorker(clock.now)
+	w.Update(ProgressEvent{TREE_STARTED, 6})
+	w.Update(ProgressEvent{TREE_JOINED, 6})
+	clock.advance(time.Second)
+	p := w.Progress()
+	// 15 of the 15 + 10 + 6 pairs were considered in a second
+	if p.Phase != "tree" || p.Done != 15 || p.Total != 31 || !closeTo(p.ETA, 16.0/15) {
+		t.Fatalf("Expected the tree phase, got %+v", p)
+	}
+}
+
+func TestProgressStopped(t *testing.T) {
+	clock := &fakeClock{time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	w := newProgressWorker(clock.now)
+	w.Update(ProgressEvent{PROFILES_EXPECTED, 10})
+	w.Update(ProgressEvent{PROFILE_INDEXED, 5})
+	clock.advance(time.Second)
+	reached := w.Progress().Progress
+
+	w.Update(ProgressEvent{RUN_CANCELLED, 0})
+	w.Update(ProgressEvent{SCORE_CALCULATED, 10})
+	w.Update(ProgressEvent{EXIT, 0})
+	if p := w.Progress(); p.Message != "Cancelled" || p.Phase != "cancelled" || p.Progress != reached {
+		t.Fatalf("Expected the run to stay cancelled at %f, got %+v", reached, p)
+	}
+
+	w = newProgressWorker(clock.now)
+	w.Update(ProgressEvent{RUN_FAILED, 0})
+	w.Update(ProgressEvent{EXIT, 0})
+	if p := w.Progress(); p.Message != "Failed" || p.Phase != "failed" || p.Progress == 100 {
+		t.Fatalf("Expected the run to have failed, got %+v", p)
+	}
+}
+
+func TestProgressWorkerFinalMessage(t *testing.T) {
+	input, output := NewProgressWorker()
+	input <- ProgressEvent{PROFILES_EXPECTED, 10}
+	input <- ProgressEvent{EXIT, 0}
+	var last ProgressMessage
+	for msg := range output {
+		last = msg
+	}
+	if last.Progress != 100 || last.Message != "Clustering complete" {
+		t.Fatalf("Expected a final 100%% message, got %+v", last)
+	}
+
+	input, output = NewProgressWorker()
+	input <- ProgressEvent{RUN_FAILED, 0}
+	input <- ProgressEvent{EXIT, 0}
+	for msg := range output {
+		last = msg
+	}
+	if last.Message != "Failed" {
+		t.Fatalf("Expected the failure to be the last message, got %+v", last)
+	}
+}
+
+// brokenWriter fails every write, like an output whose reader has gone away.
+type brokenWriter struct{}
+
+func (brokenWriter) Write(p []byte) (int, error) {
+	return 0, syscall.EPIPE
+}
+
+func TestBrokenOutput(t *testing.T) {
+	progress := make(chan ProgressMessage, 1000)
+	results := make(chan interface{}, 100)
+	done := writeDocuments(newDocumentEncoder(brokenWriter{}, nil, false), progress, results)
+
+	sent := make(chan bool)
+	go func() {
+		for i := 0; i < 3000; i++ {
+			progress <- ProgressMessage{Message: "Scoring"}
+		}
+		results <- RejectedProfiles{[]Rejection{}}
+		close(progress)
+		close(results)
+		close(sent)
+	}()
+	select {
+	case <-sent:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the documents to be drained after the output failed")
+	}
+	<-done
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+)
+
+// ProfileQC holds the quality-control metrics of a profile.  Missing is the fraction of the loci
+// which aren't called, out of the most loci given by any profile.  Novel counts the alleles which
+// no other profile has and NonNumeric the loci whose allele IDs aren't numbers, such as hashes.
+type ProfileQC struct {
+	ST         CgmlstSt `json:"ST"`
+	Called     int      `json:"called"`
+	Missing    float64  `json:"missing"`
+	Novel      int      `json:"novel"`
+	NonNumeric int      `json:"nonNumeric"`
+	Excluded   []string `json:"excluded,omitempty"` // the limits which the profile failed
+	loci       int
+}
+
+// QCLimits are the limits a profile has to be within to be clustered.  A nil limit isn't checked.
+type QCLimits struct {
+	MinCalled     int      // the fewest loci a profile can call
+	MaxMissing    *float64 // the largest fraction of loci a profile can miss
+	MaxNovel      *int     // the most alleles which no other profile has
+	MaxNonNumeric *int     // the most loci with non-numeric allele IDs
+}
+
+// QCReport is the output document with the QC table of the requested STs.
+type QCReport struct {
+	QC []ProfileQC `json:"qc"`
+}
+
+func isNumeric(allele string) bool {
+	for _, c := range allele {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return allele != ""
+}
+
+// countAllele keeps track of the number of profiles with each allele token.
+func (i *ProfilesMap) countAllele(token uint32, n int) {
+	for int(token) >= len(i.alleleCounts) {
+		i.alleleCounts = append(i.alleleCounts, 0)
+	}
+	i.alleleCounts[token] += n
+}
+
+// release frees the alleles of the profile at an offset.
+func (i *ProfilesMap) release(offset int) {
+	profile := &i.indices[offset]
+	if !profile.Ready {
+		return
+	}
+	for _, token := range profile.Alleles.ToArray() {
+		i.countAllele(token, -1)
+	}
+	profile.Alleles.Free()
+}
+
+// QualityControl measures the profiles of the STs and checks them against the limits.  It returns
+// the STs which pass in the same order and the QC table.  STs which haven't been indexed are kept
+// and left out of the table.
+func (i *ProfilesMap) QualityControl(STs []CgmlstSt, limits QCLimits) ([]CgmlstSt, QCReport) {
+	schemeLoci := 0
+	for _, qc := range i.qc {
+		if qc.loci > schemeLoci {
+			schemeLoci = qc.loci
+		}
+	}
+
+	kept := make([]CgmlstSt, 0, len(STs))
+	report := QCReport{[]ProfileQC{}}
+	for _, st := range STs {
+		offset, found := i.lookup[st]
+		qc, measured := i.qc[st]
+		if !found || !measured || !i.indices[offset].Ready {
+			kept = append(kept, st)
+			continue
+		}
+		qc.ST = st
+		if schemeLoci > 0 {
+			qc.Missing = float64(schemeLoci-qc.Called) / float64(schemeLoci)
+		}
+		for _, token := range i.indices[offset].Alleles.ToArray() {
+			if i.alleleCounts[token] == 1 {
+				qc.Novel++
+			}
+		}
+
+		if qc.Called < limits.MinCalled {
+			qc.Excluded = append(qc.Excluded, fmt.Sprintf("called %d < %d", qc.Called, limits.MinCalled))
+		}
+		if limits.MaxMissing != nil && qc.Missing > *limits.MaxMissing {
+			qc.Excluded = append(qc.Excluded, fmt.Sprintf("missing %g > %g", qc.Missing, *limits.MaxMissing))
+		}
+		if limits.MaxNovel != nil && qc.Novel > *limits.MaxNovel {
+			qc.Excluded = append(qc.Excluded, fmt.Sprintf("novel %d > %d", qc.Novel, *limits.MaxNovel))
+		}
+		if limits.MaxNonNumeric != nil && qc.NonNumeric > *limits.MaxNonNumeric {
+			qc.Excluded = append(qc.Excluded, fmt.Sprintf("nonNumeric %d > %d", qc.NonNumeric, *limits.MaxNonNumeric))
+		}
+		if len(qc.Excluded) == 0 {
+			kept = append(kept, st)
+		}
+		report.QC = append(report.QC, qc)
+	}
+	return kept, report
+}
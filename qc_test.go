@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"github.com/goccy/go-json"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestQualityControl(t *testing.T) {
+	input := strings.Join([]string{
+		`{"STs": ["A", "B", "C", "D"], "Threshold": 2, "QC": {"MinCalled": 3, "MaxNonNumeric": 0}}`,
+		`{}`,
+		`{"ST": "A", "Matches": ["1", "1", "1", "1"]}`,
+		`{"ST": "B", "Matches": ["1", "1", "1", "2"]}`,
+		`{"ST": "C", "Matches": ["1", "", "", "3"]}`,
+		`{"ST": "D", "Matches": ["1", "1", "a1b2c3", "1"]}`,
+	}, "\n")
+	var output bytes.Buffer
+	STs, _, _, err := _main(context.Background(), strings.NewReader(input), &output, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(STs, []CgmlstSt{"A", "B"}) {
+		t.Fatalf("Expected C and D to be excluded, got %v", STs)
+	}
+
+	var report QCReport
+	decoder := json.NewDecoder(&output)
+	for {
+		var doc map[string]json.RawMessage
+		if err := decoder.Decode(&doc); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if raw, found := doc["qc"]; found {
+			if err := json.Unmarshal(raw, &report.QC); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	expected := []ProfileQC{
+		{ST: "A", Called: 4, Missing: 0, Novel: 0},
+		{ST: "B", Called: 4, Missing: 0, Novel: 1},
+		{ST: "C", Called: 2, Missing: 0.5, Novel: 1, Excluded: []string{"called 2 < 3"}},
+		{ST: "D", Called: 4, Missing: 0, Novel: 1, NonNumeric: 1, Excluded: []string{"nonNumeric 1 > 0"}},
+	}
+	if !reflect.DeepEqual(report.QC, expected) {
+		t.Fatalf("Expected %+v, got %+v", expected, report.QC)
+	}
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/goccy/go-json"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Neighbour is the distance from the queried ST to another ST and the clusters the other ST is in
+// at each of the query thresholds.  Clusters are named after their last ST in the cache and are
+// empty if the ST isn't in the cache.
+type Neighbour struct {
+	ST       CgmlstSt   `json:"ST"`
+	Distance int        `json:"distance"`
+	Clusters []CgmlstSt `json:"clusters,omitempty"`
+}
+
+// QueryResult lists the nearest neighbours of a genome and, for each threshold, the clusters which
+// it would join.  If it would join more than one cluster they would be merged.
+type QueryResult struct {
+	ST         CgmlstSt     `json:"ST"`
+	Neighbours []Neighbour  `json:"neighbours"`
+	Thresholds []int        `json:"thresholds"`
+	Joins      [][]CgmlstSt `json:"joins"`
+}
+
+// nearestNeighbours compares the profile of the query to the indexed profiles and returns the k
+// closest (or all of them if k isn't positive).  Ties are broken by the order of the STs in the
+// request.
+func nearestNeighbours(index *ProfilesMap, STs []CgmlstSt, query CgmlstSt, profile BitProfiles, k int) []Neighbour {
+	comparer := newComparer(*index)
+	neighbours := make([]Neighbour, 0, len(STs))
+	seen := map[CgmlstSt]bool{query: true}
+	for _, st := range STs {
+		if seen[st] {
+			continue
+		}
+		seen[st] = true
+		neighbours = append(neighbours, Neighbour{ST: st, Distance: comparer.compareProfiles(profile, index.indices[index.lookup[st]])})
+	}
+	sort.SliceStable(neighbours, func(a, b int) bool {
+		return neighbours[a].Distance < neighbours[b].Distance
+	})
+	if k > 0 && k < len(neighbours) {
+		neighbours = neighbours[:k]
+	}
+	return neighbours
+}
+
+// Query compares an indexed ST to the other STs without scoring the whole collection.  The cached
+// pi and lambda are used to find the clusters of its neighbours.
+func Query(index *ProfilesMap, STs []CgmlstSt, cache *Cache, query CgmlstSt, k int, thresholds []int) (result QueryResult, err error) {
+	queryIdx, found := index.lookup[query]
+	if !found {
+		err = fmt.Errorf("ST '%s' wasn't in the request", query)
+		return
+	}
+	return QueryProfile(index, STs, cache, query, index.indices[queryIdx], k, thresholds)
+}
+
+// QueryProfile is Query for a profile which doesn't have to be indexed, such as one made by
+// Indexer.Detached.
+func QueryProfile(index *ProfilesMap, STs []CgmlstSt, cache *Cache, query CgmlstSt, profile BitProfiles, k int, thresholds []int) (result QueryResult, err error) {
+	nItems := len(cache.Sts)
+	if len(cache.Pi) != nItems || len(cache.Lambda) != nItems {
+		err = fmt.Errorf("the cache has %d STs but %d pi and %d lambda values", nItems, len(cache.Pi), len(cache.Lambda))
+		return
+	}
+
+	all := nearestNeighbours(index, STs, query, profile, 0)
+
+	clusters := Clusters{cache.Pi, cache.Lambda, nItems}
+	clusterOf := make(map[CgmlstSt][]CgmlstSt, nItems)
+	for i, t := range thresholds {
+		for item, id := range clusters.Get(t) {
+			st := cache.Sts[item]
+			if clusterOf[st] == nil {
+				clusterOf[st] = make([]CgmlstSt, len(thresholds))
+			}
+			clusterOf[st][i] = cache.Sts[id]
+		}
+	}
+
+	result = QueryResult{ST: query, Thresholds: thresholds, Joins: make([][]CgmlstSt, len(thresholds))}
+	for i, t := range thresholds {
+		joined := make(map[CgmlstSt]bool)
+		result.Joins[i] = []CgmlstSt{}
+		for _, n := range all {
+			if n.Distance > t {
+				break
+			}
+			if c, cached := clusterOf[n.ST]; cached && !joined[c[i]] {
+				joined[c[i]] = true
+				result.Joins[i] = append(result.Joins[i], c[i])
+			}
+		}
+	}
+
+	if k > 0 && k < len(all) {
+		all = all[:k]
+	}
+	for i := range all {
+		all[i].Clusters = clusterOf[all[i].ST]
+	}
+	result.Neighbours = all
+	return
+}
+
+// parseThresholds reads a comma separated list of thresholds.  If the list is empty it defaults to
+// every threshold from 0 to max.
+func parseThresholds(value string, max int) ([]int, error) {
+	thresholds := make([]int, 0)
+	if value == "" {
+		for t := 0; t <= max; t++ {
+			thresholds = append(thresholds, t)
+		}
+		return thresholds, nil
+	}
+	for _, field := range strings.Split(value, ",") {
+		if field = strings.TrimSpace(field); field == "" {
+			continue
+		}
+		t, err := strconv.Atoi(field)
+		if err != nil || t < 0 {
+			return nil, fmt.Errorf("invalid threshold '%s'", field)
+		}
+		thresholds = append(thresholds, t)
+	}
+	return thresholds, nil
+}
+
+// checkThresholds rejects thresholds above known, such as the threshold of the cache, because the
+// clusters aren't known above it.
+func checkThresholds(thresholds []int, known int) error {
+	for _, t := range thresholds {
+		if t > known {
+			return newPipelineError(INVALID_INPUT, "", "can't find the clusters at %d, which is above the threshold of %d", t, known)
+		}
+	}
+	return nil
+}
+
+func readProfile(path string) (profile Profile, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	err = json.NewDecoder(f).Decode(&profile)
+	return
+}
+
+func runQuery(args []string) int {
+	flags := newFlagSet("query")
+	query := flags.String("st", "", "the ST to compare to the others")
+	profilePath := flags.String("profile", "", "a file with the profile of a genome which isn't in the request")
+	k := flags.Int("k", 20, "number of neighbours to report (0 for all)")
+	thresholdList := flags.String("thresholds", "", "comma separated thresholds for the cluster membership (default 0 to the cache's threshold)")
+	format := flags.String("format", "tsv", "output format: tsv or json")
+	output := flags.String("o", "", "write the output to this file (default stdout)")
+	cacheIn := flags.String("cache-in", "", "read the cache from this file rather than from the input")
+	r, w, code := parseFlags(flags, args, output)
+	if code != EXIT_OK {
+		return code
+	}
+	defer r.Close()
+	defer w.Close()
+	ctx, stop := signalContext()
+	defer stop()
+	if (*query == "") == (*profilePath == "") {
+		flags.Usage()
+		return EXIT_USAGE
+	}
+
+	progress, stopProgress := backgroundProgress(false)
+	defer stopProgress()
+	request, cache, indexer, err := parse(ctx, r, *cacheIn, progress)
+	if err != nil {
+		return fail(err)
+	}
+	if *profilePath != "" {
+		profile, err := readProfile(*profilePath)
+		if err != nil {
+			return fail(err)
+		}
+		if _, err = indexer.Add(&profile); err != nil {
+			return fail(err)
+		}
+		*query = profile.ST
+	}
+	if err = indexer.index.Complete(); err != nil {
+		return fail(err)
+	}
+
+	known := ALMOST_INF
+	maxThreshold := request.Threshold
+	if len(cache.Sts) > 0 {
+		known = cache.Threshold
+		maxThreshold = cache.Threshold
+	}
+	thresholds, err := parseThresholds(*thresholdList, maxThreshold)
+	if err == nil {
+		err = checkThresholds(thresholds, known)
+	}
+	if err != nil {
+		return fail(err)
+	}
+
+	result, err := Query(indexer.index, request.STs, &cache, *query, *k, thresholds)
+	if err != nil {
+		return fail(err)
+	}
+
+	switch *format {
+	case "tsv":
+		err = writeQueryTable(w, result)
+	case "json":
+		err = json.NewEncoder(w).Encode(result)
+	default:
+		err = fmt.Errorf("unknown format '%s'", *format)
+	}
+	if err != nil {
+		return fail(err)
+	}
+	return EXIT_OK
+}
+
+// writeQueryTable writes a row for each neighbour with its distance and cluster at each threshold.
+func writeQueryTable(w io.Writer, result QueryResult) error {
+	buf := bufio.NewWriter(w)
+	buf.WriteString("ST\tdistance")
+	for _, t := range result.Thresholds {
+		fmt.Fprintf(buf, "\tcluster_%d", t)
+	}
+	buf.WriteString("\n")
+	for _, n := range result.Neighbours {
+		fmt.Fprintf(buf, "%s\t%d", n.ST, n.Distance)
+		for i := range result.Thresholds {
+			buf.WriteString("\t")
+			if n.Clusters != nil {
+				buf.WriteString(n.Clusters[i])
+			}
+		}
+		buf.WriteString("\n")
+	}
+	return buf.Flush()
+}
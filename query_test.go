@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestQuery(t *testing.T) {
+	progress, stopProgress := backgroundProgress(false)
+	defer stopProgress()
+	request, _, indexer, err := parse(context.Background(), fakeInput(`{"STs": ["A", "B", "C", "D"], "Threshold": 3}`, "{}", fakeProfiles), "", progress)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A-1-B-2-C-3-D
+	cache := Cache{
+		Sts:    []CgmlstSt{"A", "B", "C", "D"},
+		Pi:     []int{1, 2, 3, 3},
+		Lambda: []int{1, 2, 3, ALMOST_INF},
+	}
+
+	profile := Profile{ST: "E", Matches: fakeProfiles["E"]}
+	if _, err = indexer.Add(&profile); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := Query(indexer.index, request.STs, &cache, "E", 2, []int{0, 1, 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedNeighbours := []Neighbour{
+		{"C", 1, []CgmlstSt{"C", "C", "D"}},
+		{"A", 3, []CgmlstSt{"A", "B", "D"}},
+	}
+	if !reflect.DeepEqual(result.Neighbours, expectedNeighbours) {
+		t.Fatalf("Expected %v, got %v", expectedNeighbours, result.Neighbours)
+	}
+	expectedJoins := [][]CgmlstSt{{}, {"C"}, {"D"}}
+	if !reflect.DeepEqual(result.Joins, expectedJoins) {
+		t.Fatalf("Expected %v, got %v", expectedJoins, result.Joins)
+	}
+
+	if _, err = Query(indexer.index, request.STs, &cache, "F", 2, []int{0}); err == nil {
+		t.Fatal("Expected an error for an ST which hasn't been indexed")
+	}
+}
+
+func TestCheckThresholds(t *testing.T) {
+	if err := checkThresholds([]int{0, 3}, 3); err != nil {
+		t.Fatal(err)
+	}
+	err := checkThresholds([]int{0, 4}, 3)
+	if pipelineErr, ok := err.(*PipelineError); !ok || pipelineErr.Code != INVALID_INPUT {
+		t.Fatalf("Expected an INVALID_INPUT error, got %v", err)
+	}
+}
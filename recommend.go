@@ -0,0 +1,187 @@
+package main
+
+import (
+	"fmt"
+	"github.com/goccy/go-json"
+	"sort"
+)
+
+const RECOMMEND_CANDIDATES = 5 // the number of thresholds suggested if the request doesn't say
+
+// RecommendRequest asks for a ThresholdReport up to Max, the request's threshold if it's 0, with
+// the Candidates longest gaps and plateaus.
+type RecommendRequest struct {
+	Max        int
+	Candidates int
+}
+
+// ThresholdStats gives the number of clusters at a threshold and how many of them are singletons.
+type ThresholdStats struct {
+	Threshold  int `json:"threshold"`
+	Clusters   int `json:"clusters"`
+	Singletons int `json:"singletons"`
+}
+
+// CandidateThreshold is a threshold which is stable over a range.  For a "gap" no pair of STs is
+// between Threshold + 1 and Threshold + Length apart, for a "plateau" the number of clusters is the
+// same from Threshold to Threshold + Length - 1.
+type CandidateThreshold struct {
+	Threshold int    `json:"threshold"`
+	Reason    string `json:"reason"`
+	Length    int    `json:"length"`
+}
+
+// ThresholdReport summarises the distribution of the distances.  Histogram counts the pairs of STs
+// at each distance up to the largest; Incomparable counts those which couldn't be compared.
+type ThresholdReport struct {
+	Histogram    []int                `json:"histogram"`
+	Incomparable int                  `json:"incomparable"`
+	Thresholds   []ThresholdStats     `json:"thresholds"`
+	Candidates   []CandidateThreshold `json:"candidates"`
+}
+
+// RecommendThresholds looks for gaps in the distances and plateaus in the number of clusters up to
+// max and returns the nCandidates longest.
+func RecommendThresholds(distances []int, clusters Clusters, max int, nCandidates int) ThresholdReport {
+	report := ThresholdReport{Histogram: []int{}, Thresholds: []ThresholdStats{}, Candidates: []CandidateThreshold{}}
+	for _, distance := range distances {
+		if distance >= ALMOST_INF || distance < 0 {
+			report.Incomparable++
+			continue
+		}
+		for len(report.Histogram) <= distance {
+			report.Histogram = append(report.Histogram, 0)
+		}
+		report.Histogram[distance]++
+	}
+
+	for t := 0; t <= max; t++ {
+		stats := ThresholdStats{Threshold: t}
+		sizes := make(map[int]int)
+		for _, id := range clusters.Get(t) {
+			sizes[id]++
+		}
+		stats.Clusters = len(sizes)
+		for _, size := range sizes {
+			if size == 1 {
+				stats.Singletons++
+			}
+		}
+		report.Thresholds = append(report.Thresholds, stats)
+	}
+
+	candidates := make([]CandidateThreshold, 0)
+	// Gaps between distances which are seen, ignoring those after the last one
+	last := len(report.Histogram) - 1
+	if last > max {
+		last = max
+	}
+	for d := 1; d <= last; d++ {
+		if report.Histogram[d] != 0 || report.Histogram[d-1] == 0 {
+			continue
+		}
+		end := d
+		for end < len(report.Histogram) && report.Histogram[end] == 0 {
+			end++
+		}
+		if end < len(report.Histogram) {
+			candidates = append(candidates, CandidateThreshold{d - 1, "gap", end - d})
+		}
+	}
+	// Plateaus which don't reach max and aren't everything in one cluster or all singletons
+	for start := 0; start <= max; {
+		end := start
+		for end <= max && report.Thresholds[end].Clusters == report.Thresholds[start].Clusters {
+			end++
+		}
+		if n := report.Thresholds[start].Clusters; end <= max && n > 1 && n < clusters.nItems {
+			candidates = append(candidates, CandidateThreshold{start, "plateau", end - start})
+		}
+		start = end
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		if candidates[i].Length != candidates[j].Length {
+			return candidates[i].Length > candidates[j].Length
+		}
+		return candidates[i].Threshold < candidates[j].Threshold
+	})
+	seen := make(map[int]bool)
+	for _, candidate := range candidates {
+		if len(report.Candidates) >= nCandidates {
+			break
+		}
+		if !seen[candidate.Threshold] {
+			seen[candidate.Threshold] = true
+			report.Candidates = append(report.Candidates, candidate)
+		}
+	}
+	return report
+}
+
+// recommend sends the ThresholdReport if the request asks for one.  Every distance has to be known,
+// so the cache isn't reused.
+func recommend(request Request, distances []int, clusters Clusters, results chan interface{}) {
+	if request.Recommend == nil {
+		return
+	}
+	max, nCandidates := request.Recommend.Max, request.Recommend.Candidates
+	if max == 0 {
+		max = request.Threshold
+	}
+	if nCandidates == 0 {
+		nCandidates = RECOMMEND_CANDIDATES
+	}
+	results <- RecommendThresholds(distances, clusters, max, nCandidates)
+}
+
+// runRecommend runs the pipeline with a RecommendRequest and only writes the ThresholdReport.
+func runRecommend(args []string) int {
+	var p pipelineFlags
+	flags := newFlagSet("recommend")
+	p.register(flags)
+	max := flags.Int("max", 50, "the largest threshold to consider (0 for the request's threshold)")
+	nCandidates := flags.Int("candidates", 5, "the number of thresholds to suggest")
+	r, w, code := parseFlags(flags, args, &p.output)
+	if code != EXIT_OK {
+		return code
+	}
+	defer r.Close()
+	defer w.Close()
+	ctx, cancel := p.context()
+	defer cancel()
+	if *max < 0 {
+		return fail(fmt.Errorf("the maximum threshold can't be negative"))
+	}
+
+	progress, stopProgress := backgroundProgress(p.verbose)
+	defer stopProgress()
+	opts := p.options()
+	opts.Recommend = &RecommendRequest{*max, *nCandidates}
+	request, cache, indexer, err := parseChecked(ctx, r, opts.CacheIn, planRequest(opts, true), progress)
+	if err != nil {
+		return fail(err)
+	}
+
+	// The other documents are dropped
+	results := make(chan interface{})
+	reports := make(chan ThresholdReport, 1)
+	go func() {
+		defer close(reports)
+		for result := range results {
+			if report, isReport := result.(ThresholdReport); isReport {
+				reports <- report
+			}
+		}
+	}()
+	_, _, err = runClustering(ctx, request, &cache, indexer.index, opts, progress, results, nil)
+	close(results)
+	report := <-reports
+	if err != nil {
+		return fail(err)
+	}
+	if err = json.NewEncoder(w).Encode(report); err != nil {
+		return fail(err)
+	}
+	return EXIT_OK
+}
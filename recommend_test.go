@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"github.com/goccy/go-json"
+	"io"
+	"reflect"
+	"testing"
+)
+
+func TestRecommendThresholds(t *testing.T) {
+	// Two groups, {A, B, C} and {D, E}, which are 6 or more apart
+	distances := []int{
+		1,
+		2, 1,
+		7, 6, 8,
+		6, 7, 7, 1,
+	}
+	clusters, err := ClusterFromScratch(distances, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	report := RecommendThresholds(append(distances, ALMOST_INF), clusters, 7, 2)
+
+	if expected := []int{0, 3, 1, 0, 0, 0, 2, 3, 1}; !reflect.DeepEqual(report.Histogram, expected) {
+		t.Fatalf("Expected %v, got %v", expected, report.Histogram)
+	}
+	if report.Incomparable != 1 {
+		t.Fatalf("Expected 1 incomparable pair, got %d", report.Incomparable)
+	}
+	if expected := (ThresholdStats{1, 2, 0}); report.Thresholds[1] != expected {
+		t.Fatalf("Expected %v, got %v", expected, report.Thresholds[1])
+	}
+	if expected := (ThresholdStats{0, 5, 5}); report.Thresholds[0] != expected {
+		t.Fatalf("Expected %v, got %v", expected, report.Thresholds[0])
+	}
+
+	expected := []CandidateThreshold{{1, "plateau", 5}, {2, "gap", 3}}
+	if !reflect.DeepEqual(report.Candidates, expected) {
+		t.Fatalf("Expected %v, got %v", expected, report.Candidates)
+	}
+}
+
+func TestRecommendRequest(t *testing.T) {
+	input := fakeInput(`{"STs": ["A", "B", "C", "D", "E"], "Threshold": 3, "Recommend": {"Candidates": 2}}`, "{}", fakeProfiles)
+	var output bytes.Buffer
+	_, clusters, distances, err := _main(context.Background(), input, &output, Options{Envelope: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var report *ThresholdReport
+	decoder := json.NewDecoder(&output)
+	for {
+		var doc struct {
+			Type string
+			Data json.RawMessage
+		}
+		if err := decoder.Decode(&doc); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if doc.Type == DOC_RECOMMEND {
+			report = &ThresholdReport{}
+			if err = json.Unmarshal(doc.Data, report); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if expected := RecommendThresholds(distances, clusters, 3, 2); report == nil || !reflect.DeepEqual(*report, expected) {
+		t.Fatalf("Expected %v, got %v", expected, report)
+	}
+}
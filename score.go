@@ -1,10 +1,13 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"log"
 	"runtime"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
 import _ "go.uber.org/automaxprocs"
@@ -14,9 +17,18 @@ type Comparer struct {
 	minMatchingGenes int
 }
 
+// newComparer requires profiles to share at least 80% of the genes in the scheme before they are
+// compared.
+func newComparer(profilesMap ProfilesMap) *Comparer {
+	return &Comparer{profilesMap, int(profilesMap.schemeSize * 8 / 10)}
+}
+
 func (c *Comparer) compare(stA int, stB int) int {
-	profileA := c.profilesMap.indices[stA]
-	profileB := c.profilesMap.indices[stB]
+	return c.compareProfiles(c.profilesMap.indices[stA], c.profilesMap.indices[stB])
+}
+
+// compareProfiles is compare for profiles which might not be in the index.
+func (c *Comparer) compareProfiles(profileA BitProfiles, profileB BitProfiles) int {
 	geneCount := CompareBits(profileA.Genes, profileB.Genes)
 	if geneCount < c.minMatchingGenes {
 		return ALMOST_INF
@@ -25,7 +37,7 @@ func (c *Comparer) compare(stA int, stB int) int {
 	return geneCount - alleleCount
 }
 
-func scoreProfiles(jobs chan Batch, scores *ScoresStore, comparer *Comparer, wg *sync.WaitGroup) {
+func scoreProfiles(ctx context.Context, jobs chan Batch, scores *ScoresStore, comparer *Comparer, progress chan ProgressEvent, wg *sync.WaitGroup) {
 	//nScores := 0
 	//defer func() {
 	//	log.Printf("Worker %d has computed %d scores", workerID, nScores)
@@ -36,6 +48,11 @@ func scoreProfiles(jobs chan Batch, scores *ScoresStore, comparer *Comparer, wg
 		if !more {
 			return
 		}
+		if ctx.Err() != nil {
+			// Drain the remaining jobs without scoring them
+			continue
+		}
+		started := time.Now()
 		profiles := *job.profileIndex
 		scoreIndex := job.scoreIndex
 		for i := 0; i < job.endIndex; i++ {
@@ -50,6 +67,9 @@ func scoreProfiles(jobs chan Batch, scores *ScoresStore, comparer *Comparer, wg
 			//	log.Printf("Worker %d has computed %d scores", workerID, nScores)
 			//}
 		}
+		atomic.StoreInt32(&scores.scored[job.endIndex], 1)
+		progress <- ProgressEvent{WORKER_BUSY, int(time.Since(started))}
+		progress <- ProgressEvent{SCORE_CALCULATED, job.endIndex}
 	}
 }
 
@@ -59,6 +79,7 @@ type ScoresStore struct {
 	todo          int32 // remaining scores to compute
 	canReuseCache bool  // can reuse the cached clustering
 	cacheSize     int
+	scored        []int32 // 1 for each row which has been scored, allocated by RunScoring or a checkpoint
 }
 
 func (s *ScoresStore) Done() int {
@@ -89,7 +110,7 @@ func sortSts(requestSts []CgmlstSt, cache *Cache, profiles *ProfilesMap) (canReu
 			// The cache contains STs we don't need
 			canReuseCache = false
 			cacheToScoresMap[cacheIdx] = -1
-			fmt.Println("Skipping ST in cache: ", st)
+			log.Println("Skipping ST in cache: ", st)
 		} else {
 			seenSTs[st] = scoresIdx
 			STs[scoresIdx] = st
@@ -118,6 +139,12 @@ func NewScores(request Request, cache *Cache, profiles *ProfilesMap) (s ScoresSt
 	//fmt.Println("STs in cache: ", len(cache.Sts))
 	var cacheToScoresMap []int
 	s.canReuseCache, s.STs, cacheToScoresMap, s.cacheSize = sortSts(request.STs, cache, profiles)
+	if requested, _ := normaliseLinkage(request.Linkage); requested != SINGLE_LINKAGE {
+		// Only single linkage can extend the cached clustering
+		s.canReuseCache = false
+	} else if cached, _ := normaliseLinkage(cache.Linkage); cached != SINGLE_LINKAGE {
+		s.canReuseCache = false
+	}
 	nSTs := len(s.STs)
 	s.scores = make([]int, nSTs*(nSTs-1)/2)
 
@@ -130,7 +157,7 @@ func NewScores(request Request, cache *Cache, profiles *ProfilesMap) (s ScoresSt
 	)
 	for scoresIdx, st := range s.STs {
 		if stA, found = profiles.lookup[st]; !found {
-			err = fmt.Errorf("could not find ST '%s' in profilesMap", st)
+			err = newPipelineError(MISSING_PROFILE, st, "could not find ST '%s' in profilesMap", st)
 			return
 		}
 		scoresToProfileMap[scoresIdx] = stA
@@ -265,6 +292,10 @@ func indexCache(STs *[]CgmlstSt, stIndexMap *map[CgmlstSt]int, cacheSize int) (i
 	var i int
 	var st string
 	if cacheSize == 0 {
+		// The first ST isn't scored against anything so RunScoring won't look up its profile
+		if len(*STs) > 0 {
+			profileIndex[0] = (*stIndexMap)[(*STs)[0]]
+		}
 		return 0, &profileIndex
 	} else if cacheSize == 1 {
 		profileIndex[0] = (*stIndexMap)[(*STs)[0]]
@@ -286,44 +317,58 @@ type Batch struct {
 	endIndex, scoreIndex int
 }
 
-func (s *ScoresStore) RunScoring(profileMap ProfilesMap, progress chan ProgressEvent) (done chan bool, err chan error) {
-	numWorkers := runtime.NumCPU() + 1
+// RunScoring calculates the missing scores using numWorkers goroutines.  If numWorkers isn't
+// positive it defaults to one more than the number of CPUs.  Rows which were resumed from a
+// checkpoint are skipped.  If the context is cancelled no more work is handed out and done is sent
+// once the workers have finished their current batch.
+func (s *ScoresStore) RunScoring(ctx context.Context, profileMap ProfilesMap, numWorkers int, progress chan ProgressEvent) (done chan bool, err chan error) {
+	if numWorkers <= 0 {
+		numWorkers = runtime.NumCPU() + 1
+	}
 	var scoreWg sync.WaitGroup
 
 	err = make(chan error)
-	done = make(chan bool)
+	done = make(chan bool, 1)
+	if s.scored == nil {
+		s.scored = make([]int32, len(s.STs))
+	}
 
 	_scoreTasks := make(chan Batch, 5000)
 	scoreTasks := make(chan Batch, 5000)
 	go func() {
+		defer close(scoreTasks)
 		for task := range _scoreTasks {
+			if ctx.Err() != nil {
+				continue
+			}
 			scoreTasks <- task
-			progress <- ProgressEvent{SCORE_CALCULATED, task.endIndex - 1}
 		}
-		close(scoreTasks)
 	}()
 
 	go func() {
 		scoreIndex, profileIndex := indexCache(&s.STs, &profileMap.lookup, s.cacheSize)
 		profileIndexD := *profileIndex
 		stCount := len(s.STs)
-		for i := max(s.cacheSize, 1); i < stCount; i++ {
+		for i := max(s.cacheSize, 1); i < stCount && ctx.Err() == nil; i++ {
 			stAProfile := profileMap.lookup[s.STs[i]]
 			profileIndexD[i] = stAProfile // Adds profile to list of profiles, so it can be looked up directly after
-			_scoreTasks <- Batch{profileIndex: &profileIndexD, endIndex: i, scoreIndex: scoreIndex}
+			if atomic.LoadInt32(&s.scored[i]) == 0 {
+				_scoreTasks <- Batch{profileIndex: &profileIndexD, endIndex: i, scoreIndex: scoreIndex}
+			}
 			scoreIndex += i
 		}
 		close(_scoreTasks)
 	}()
 
-	minMatchingGenes := int(profileMap.schemeSize * 8 / 10)
+	progress <- ProgressEvent{WORKERS_STARTED, numWorkers}
 	for i := 1; i <= numWorkers; i++ {
 		scoreWg.Add(1)
-		go scoreProfiles(scoreTasks, s, &Comparer{profileMap, minMatchingGenes}, &scoreWg)
+		go scoreProfiles(ctx, scoreTasks, s, newComparer(profileMap), progress, &scoreWg)
 	}
 
 	go func() {
 		scoreWg.Wait()
+		progress <- ProgressEvent{WORKERS_STOPPED, numWorkers}
 		done <- true
 	}()
 
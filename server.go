@@ -0,0 +1,365 @@
+package main
+
+import (
+	"context"
+	"github.com/goccy/go-json"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// organism holds the indexed profiles and the latest clustering for one organism.  Requests for the
+// same organism are handled one at a time.
+type organism struct {
+	sync.Mutex
+	indexer *Indexer
+	cache   *Cache
+}
+
+// Server keeps the profiles of each organism in memory between requests so that only new profiles
+// need to be indexed.
+type Server struct {
+	sync.Mutex
+	organisms map[string]*organism
+	opts      Options
+}
+
+func NewServer(opts Options) *Server {
+	return &Server{organisms: make(map[string]*organism), opts: opts}
+}
+
+func (s *Server) organism(id string) *organism {
+	s.Lock()
+	defer s.Unlock()
+	o, found := s.organisms[id]
+	if !found {
+		o = &organism{indexer: NewIndexer([]CgmlstSt{}), cache: NewCache()}
+		s.organisms[id] = o
+	}
+	return o
+}
+
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /organisms/{organism}", s.handleStatus)
+	mux.HandleFunc("POST /organisms/{organism}/profiles", s.handleAddProfiles)
+	mux.HandleFunc("DELETE /organisms/{organism}/profiles/{st}", s.handleRemoveProfile)
+	mux.HandleFunc("POST /organisms/{organism}/cluster", s.handleCluster)
+	mux.HandleFunc("POST /organisms/{organism}/query", s.handleQuery)
+	mux.HandleFunc("POST /organisms/{organism}/append", s.handleAppend)
+	mux.Handle("GET /metrics", metrics)
+	return mux
+}
+
+// writeError writes an ErrorOutput document, giving the error a code and a phase unless it already
+// has them.
+func writeError(w http.ResponseWriter, status int, err error, code string, phase string) {
+	writeJSON(w, status, ErrorOutput{asPipelineError(err, code, phase)})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Println(err)
+	}
+}
+
+// OrganismStatus describes what the server holds in memory for an organism
+type OrganismStatus struct {
+	Profiles []CgmlstSt  `json:"profiles"`
+	Cache    CacheReport `json:"cache"`
+}
+
+func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
+	o := s.organism(r.PathValue("organism"))
+	o.Lock()
+	defer o.Unlock()
+
+	status := OrganismStatus{Profiles: make([]CgmlstSt, 0, len(o.indexer.index.lookup)), Cache: o.cache.Inspect()}
+	for st := range o.indexer.index.lookup {
+		status.Profiles = append(status.Profiles, st)
+	}
+	sort.Strings(status.Profiles)
+	writeJSON(w, http.StatusOK, status)
+}
+
+// handleAddProfiles indexes a stream of profile documents.  Profiles which are already indexed are
+// ignored.
+func (s *Server) handleAddProfiles(w http.ResponseWriter, r *http.Request) {
+	o := s.organism(r.PathValue("organism"))
+	o.Lock()
+	defer o.Unlock()
+
+	added, duplicates := 0, 0
+	decoder := json.NewDecoder(r.Body)
+	for {
+		var profile Profile
+		if err := decoder.Decode(&profile); err == io.EOF {
+			break
+		} else if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]interface{}{"error": asPipelineError(err, INVALID_INPUT, PHASE_PARSING), "added": added})
+			return
+		}
+		if duplicate, err := o.indexer.Add(&profile); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]interface{}{"error": asPipelineError(err, INVALID_INPUT, PHASE_PARSING), "added": added})
+			return
+		} else if duplicate {
+			duplicates++
+		} else {
+			added++
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]int{"added": added, "duplicates": duplicates})
+}
+
+func (s *Server) handleRemoveProfile(w http.ResponseWriter, r *http.Request) {
+	o := s.organism(r.PathValue("organism"))
+	o.Lock()
+	defer o.Unlock()
+
+	if !o.indexer.Remove(r.PathValue("st")) {
+		writeError(w, http.StatusNotFound, newPipelineError(MISSING_PROFILE, r.PathValue("st"), "profile not found"), MISSING_PROFILE, PHASE_PARSING)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleCluster takes the same documents as the command line: a request, a cache and profiles.  The
+// cache may be empty (`{}`) to extend the latest clustering held by the server and only profiles
+// which haven't already been indexed need to be sent.  Progress and results are streamed back as
+// newline delimited JSON and the result becomes the cache for the next request.  The run is
+// cancelled if the client goes away, the server shuts down or the maximum runtime passes.
+func (s *Server) handleCluster(w http.ResponseWriter, r *http.Request) {
+	o := s.organism(r.PathValue("organism"))
+	o.Lock()
+	defer o.Unlock()
+
+	ctx, cancel := s.opts.withMaxRuntime(r.Context())
+	defer cancel()
+	progressIn, progressOut := NewProgressWorker()
+	failed := func(err error, code string) {
+		status := http.StatusBadRequest
+		if isCancelled(err) {
+			progressIn <- ProgressEvent{RUN_CANCELLED, 0}
+			status = http.StatusServiceUnavailable
+		} else {
+			progressIn <- ProgressEvent{RUN_FAILED, 0}
+		}
+		progressIn <- ProgressEvent{EXIT, 0}
+		writeError(w, status, err, code, PHASE_PARSING)
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	request, cache, err := parseRequest(decoder, "", progressIn)
+	if err != nil {
+		failed(err, INVALID_INPUT)
+		return
+	}
+	if err = planRequest(s.opts, true)(request); err != nil {
+		failed(err, INSUFFICIENT_MEMORY)
+		return
+	}
+	if err = parseProfiles(ctx, decoder, o.indexer.Add, nil, progressIn); err != nil {
+		failed(err, INVALID_INPUT)
+		return
+	}
+	previous := &cache
+	if len(cache.Sts) == 0 {
+		previous = o.cache
+	}
+	STs := request.STs
+	if request.Lenient || s.opts.Lenient {
+		// The STs without profiles are reported by runClustering
+		STs, _ = o.indexer.index.Accept(STs)
+	}
+	index, err := o.indexer.index.Subset(STs)
+	if err != nil {
+		failed(err, MISSING_PROFILE)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	results := make(chan interface{}, 100)
+	enc := newDocumentEncoder(w, nil, false)
+	done := writeDocuments(enc, progressOut, results)
+	output := NewCacheOutput()
+	_, _, err = runClustering(ctx, request, previous, index, s.opts, progressIn, results, &output)
+	if err != nil {
+		// The status has already been sent so the error is the last document of the stream
+		log.Println(err)
+		finishDocuments(enc, progressIn, results, done, asPipelineError(err, CLUSTERING_FAILED, PHASE_CLUSTERING))
+		return
+	}
+	finishDocuments(enc, progressIn, results, done, nil)
+	o.cache = output.Cache()
+}
+
+// handleQuery compares one profile to every profile held for the organism and uses the latest
+// clustering to find the clusters it would join.  The profile is never indexed, so a profile held
+// with the same ST is left alone and isn't one of the neighbours.  The number of neighbours and the
+// thresholds can be given as the `k` and `thresholds` query parameters.
+func (s *Server) handleQuery(w http.ResponseWriter, r *http.Request) {
+	o := s.organism(r.PathValue("organism"))
+	o.Lock()
+	defer o.Unlock()
+
+	k := 20
+	if value := r.URL.Query().Get("k"); value != "" {
+		var err error
+		if k, err = strconv.Atoi(value); err != nil {
+			writeError(w, http.StatusBadRequest, newPipelineError(INVALID_INPUT, "", "k should be a number"), INVALID_INPUT, PHASE_PARSING)
+			return
+		}
+	}
+	thresholds, err := parseThresholds(r.URL.Query().Get("thresholds"), o.cache.Threshold)
+	if err == nil && len(o.cache.Sts) > 0 {
+		err = checkThresholds(thresholds, o.cache.Threshold)
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err, INVALID_INPUT, PHASE_PARSING)
+		return
+	}
+
+	var profile Profile
+	if err := json.NewDecoder(r.Body).Decode(&profile); err != nil {
+		writeError(w, http.StatusBadRequest, err, INVALID_INPUT, PHASE_PARSING)
+		return
+	}
+	query := o.indexer.Detached(&profile)
+	defer query.Alleles.Free()
+
+	// Prefer the order of the cache when neighbours are the same distance away
+	STs := make([]CgmlstSt, 0, len(o.indexer.index.lookup))
+	inCache := make(map[CgmlstSt]bool, len(o.cache.Sts))
+	for _, st := range o.cache.Sts {
+		if _, indexed := o.indexer.index.lookup[st]; indexed && !inCache[st] {
+			STs = append(STs, st)
+		}
+		inCache[st] = true
+	}
+	others := make([]CgmlstSt, 0)
+	for st := range o.indexer.index.lookup {
+		if !inCache[st] {
+			others = append(others, st)
+		}
+	}
+	sort.Strings(others)
+	STs = append(STs, others...)
+
+	result, err := QueryProfile(o.indexer.index, STs, o.cache, profile.ST, query, k, thresholds)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err, CLUSTERING_FAILED, PHASE_SCORING)
+		return
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+// handleAppend indexes a stream of profiles and adds their STs to the latest clustering without
+// rescoring the STs which were already clustered.  The threshold defaults to the threshold of the
+// latest clustering and can be given as the `threshold` query parameter.  If the profiles can't be
+// read or appended the ones which weren't held before are removed again.
+func (s *Server) handleAppend(w http.ResponseWriter, r *http.Request) {
+	o := s.organism(r.PathValue("organism"))
+	o.Lock()
+	defer o.Unlock()
+
+	threshold := o.cache.Threshold
+	if value := r.URL.Query().Get("threshold"); value != "" {
+		var err error
+		if threshold, err = strconv.Atoi(value); err != nil {
+			writeError(w, http.StatusBadRequest, newPipelineError(INVALID_INPUT, "", "threshold should be a number"), INVALID_INPUT, PHASE_PARSING)
+			return
+		}
+	}
+
+	STs := make([]CgmlstSt, 0)
+	added := make([]CgmlstSt, 0) // the STs which weren't held before
+	rollback := func() {
+		for _, st := range added {
+			o.indexer.Remove(st)
+		}
+	}
+	decoder := json.NewDecoder(r.Body)
+	for {
+		var profile Profile
+		if err := decoder.Decode(&profile); err == io.EOF {
+			break
+		} else if err != nil {
+			rollback()
+			writeError(w, http.StatusBadRequest, err, INVALID_INPUT, PHASE_PARSING)
+			return
+		}
+		if _, held := o.indexer.index.lookup[profile.ST]; !held {
+			added = append(added, profile.ST)
+		}
+		if _, err := o.indexer.Add(&profile); err != nil {
+			rollback()
+			writeError(w, http.StatusBadRequest, err, INVALID_INPUT, PHASE_PARSING)
+			return
+		}
+		STs = append(STs, profile.ST)
+	}
+
+	ctx, cancel := s.opts.withMaxRuntime(r.Context())
+	defer cancel()
+	progressIn, stopProgress := backgroundProgress(false)
+	defer stopProgress()
+	output, updated, err := Append(ctx, o.cache, o.indexer.index, STs, threshold, s.opts.Workers, progressIn)
+	if err != nil {
+		rollback()
+		if isCancelled(err) {
+			progressIn <- ProgressEvent{RUN_CANCELLED, 0}
+		} else {
+			progressIn <- ProgressEvent{RUN_FAILED, 0}
+		}
+		writeError(w, http.StatusBadRequest, err, INVALID_CACHE, PHASE_CLUSTERING)
+		return
+	}
+	o.cache = updated
+	writeJSON(w, http.StatusOK, output)
+}
+
+// runServe serves until SIGINT or SIGTERM.  The requests which are running are then cancelled and
+// the server waits for them to write their error documents before exiting.
+func runServe(args []string) int {
+	flags := newFlagSet("serve")
+	listen := flags.String("listen", ":8080", "address to listen on")
+	metricsAddr := flags.String("metrics", "", "also serve the metrics on this address, they're always at /metrics on the main address")
+	workers := flags.Int("workers", 0, "number of scoring workers (default one more than the number of CPUs)")
+	maxRuntime := flags.Duration("max-runtime", 0, "cancel a clustering request after this long, e.g. 30m (default no limit)")
+	var memoryLimit memoryLimitFlag
+	flags.Var(&memoryLimit, "memory-limit", MEMORY_LIMIT_USAGE)
+	if err := flags.Parse(args); err != nil {
+		return EXIT_USAGE
+	}
+	defer serveMetrics(*metricsAddr)()
+	ctx, stop := signalContext()
+	defer stop()
+	server := NewServer(Options{Workers: *workers, MaxRuntime: *maxRuntime, MemoryLimit: int64(memoryLimit)})
+	httpServer := &http.Server{
+		Addr:        *listen,
+		Handler:     server.Handler(),
+		BaseContext: func(net.Listener) context.Context { return ctx },
+	}
+	shutdown := make(chan error)
+	go func() {
+		<-ctx.Done()
+		log.Println("Shutting down")
+		shutdown <- httpServer.Shutdown(context.Background())
+	}()
+
+	log.Printf("Listening on %s\n", *listen)
+	if err := httpServer.ListenAndServe(); err != http.ErrServerClosed {
+		return fail(err)
+	}
+	// Shutdown returns once the requests have finished
+	if err := <-shutdown; err != nil {
+		return fail(err)
+	}
+	return EXIT_OK
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"github.com/goccy/go-json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func postDocuments(t *testing.T, url string, body io.Reader) []ClusterOutput {
+	response, err := http.Post(url, "application/x-ndjson", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(response.Body)
+		t.Fatalf("Got status %d: %s", response.StatusCode, msg)
+	}
+	outputs := make([]ClusterOutput, 0)
+	decoder := json.NewDecoder(response.Body)
+	for {
+		var doc map[string]json.RawMessage
+		if err := decoder.Decode(&doc); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if _, isProgress := doc["progress"]; isProgress {
+			continue
+		}
+		var output ClusterOutput
+		raw, _ := json.Marshal(doc)
+		if err := json.Unmarshal(raw, &output); err != nil {
+			t.Fatal(err)
+		}
+		outputs = append(outputs, output)
+	}
+	return outputs
+}
+
+func TestServer(t *testing.T) {
+	server := httptest.NewServer(NewServer(Options{}).Handler())
+	defer server.Close()
+
+	profiles := fakeInput(`{"ST": "A", "Matches": ["1", "1", "1", "1", "1", "1"]}`, "", map[CgmlstSt][]string{
+		"B": fakeProfiles["B"],
+		"C": fakeProfiles["C"],
+	})
+	response, err := http.Post(server.URL+"/organisms/1280/profiles", "application/x-ndjson", profiles)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var added map[string]int
+	if err = json.NewDecoder(response.Body).Decode(&added); err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if added["added"] != 3 {
+		t.Fatalf("Expected 3 profiles to be added, got %v", added)
+	}
+
+	outputs := postDocuments(t, server.URL+"/organisms/1280/cluster", strings.NewReader(`{"STs": ["A", "B", "C"], "Threshold": 3}`+"\n{}\n"))
+	if len(outputs) != 5 {
+		t.Fatalf("Expected 5 documents, got %d", len(outputs))
+	}
+
+	// The server reuses the profiles and the clustering from the first request
+	input := fakeInput(`{"STs": ["A", "B", "C", "D", "E"], "Threshold": 3}`, "{}", map[CgmlstSt][]string{
+		"D": fakeProfiles["D"],
+		"E": fakeProfiles["E"],
+	})
+	outputs = postDocuments(t, server.URL+"/organisms/1280/cluster", input)
+	last := outputs[len(outputs)-1]
+
+	STs, expected, _, err := _main(context.Background(), fakeInput(`{"STs": ["A", "B", "C", "D", "E"], "Threshold": 3}`, "{}", fakeProfiles), &bytes.Buffer{}, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(last.Sts, STs) {
+		t.Fatalf("Expected %v, got %v", STs, last.Sts)
+	}
+	compareSlices(t, last.Pi, expected.pi)
+	compareSlices(t, last.Lambda, expected.lambda)
+
+	query := `{"ST": "F", "Matches": ["1", "1", "1", "2", "2", "4"]}`
+	if response, err = http.Post(server.URL+"/organisms/1280/query?k=1&thresholds=0,1", "application/json", strings.NewReader(query)); err != nil {
+		t.Fatal(err)
+	}
+	var result QueryResult
+	if err = json.NewDecoder(response.Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if len(result.Neighbours) != 1 || result.Neighbours[0].ST != "C" || result.Neighbours[0].Distance != 1 {
+		t.Fatalf("Unexpected neighbours %v", result.Neighbours)
+	}
+
+	request, _ := http.NewRequest(http.MethodDelete, server.URL+"/organisms/1280/profiles/E", nil)
+	if response, err = http.DefaultClient.Do(request); err != nil {
+		t.Fatal(err)
+	} else if response.StatusCode != http.StatusNoContent {
+		t.Fatalf("Expected profile to be removed, got %d", response.StatusCode)
+	}
+
+	if response, err = http.Get(server.URL + "/organisms/1280"); err != nil {
+		t.Fatal(err)
+	}
+	var status OrganismStatus
+	if err = json.NewDecoder(response.Body).Decode(&status); err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if !reflect.DeepEqual(status.Profiles, []CgmlstSt{"A", "B", "C", "D"}) {
+		t.Fatalf("Unexpected profiles %v", status.Profiles)
+	}
+	if status.Cache.STs != 5 {
+		t.Fatalf("Expected the latest clustering to have 5 STs, got %d", status.Cache.STs)
+	}
+}
+
+func postQuery(t *testing.T, url string, query string) QueryResult {
+	response, err := http.Post(url, "application/json", strings.NewReader(query))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	var result QueryResult
+	if err = json.NewDecoder(response.Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+	return result
+}
+
+func TestServerQueryIsDetached(t *testing.T) {
+	s := NewServer(Options{})
+	server := httptest.NewServer(s.Handler())
+	defer server.Close()
+	held := map[CgmlstSt][]string{"A": fakeProfiles["A"], "B": fakeProfiles["B"], "C": fakeProfiles["C"]}
+	postDocuments(t, server.URL+"/organisms/1280/cluster", fakeInput(`{"STs": ["A", "B", "C"], "Threshold": 3}`, "{}", held))
+	indexer := s.organism("1280").indexer
+	tokens := len(indexer.alleleTokens.lookup)
+
+	// The posted profile of A is compared with the others rather than ignored for the held one
+	result := postQuery(t, server.URL+"/organisms/1280/query", `{"ST": "A", "Matches": ["1", "1", "1", "2", "2", "9"]}`)
+	if len(result.Neighbours) != 2 || result.Neighbours[0].ST != "C" || result.Neighbours[0].Distance != 1 || result.Neighbours[1].ST != "B" || result.Neighbours[1].Distance != 3 {
+		t.Fatalf("Unexpected neighbours %v", result.Neighbours)
+	}
+	if len(indexer.alleleTokens.lookup) != tokens {
+		t.Fatalf("Expected the query's alleles not to be kept, got %d tokens rather than %d", len(indexer.alleleTokens.lookup), tokens)
+	}
+
+	// The cache doesn't know the clusters above its threshold
+	response, err := http.Post(server.URL+"/organisms/1280/query?thresholds=4", "application/json", strings.NewReader(`{"ST": "F", "Matches": ["1", "1", "1", "1", "1", "1"]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Expected a threshold above the cache's to be rejected, got %d", response.StatusCode)
+	}
+
+	// The held profile of A hasn't changed
+	result = postQuery(t, server.URL+"/organisms/1280/query?k=1", `{"ST": "F", "Matches": ["1", "1", "1", "1", "1", "1"]}`)
+	if len(result.Neighbours) != 1 || result.Neighbours[0].ST != "A" || result.Neighbours[0].Distance != 0 {
+		t.Fatalf("Expected A to still be held with its own profile, got %v", result.Neighbours)
+	}
+}
+
+func TestServerAppendRollback(t *testing.T) {
+	server := httptest.NewServer(NewServer(Options{}).Handler())
+	defer server.Close()
+	held := map[CgmlstSt][]string{"A": fakeProfiles["A"], "B": fakeProfiles["B"], "C": fakeProfiles["C"]}
+	postDocuments(t, server.URL+"/organisms/1280/cluster", fakeInput(`{"STs": ["A", "B", "C"], "Threshold": 3, "Linkage": "complete"}`, "{}", held))
+
+	// A complete linkage clustering can't be appended to
+	profiles := fakeInput(`{"ST": "D", "Matches": ["2", "2", "2", "2", "2", "2"]}`, "", nil)
+	response, err := http.Post(server.URL+"/organisms/1280/append", "application/x-ndjson", profiles)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Expected the append to fail, got %d", response.StatusCode)
+	}
+
+	if response, err = http.Get(server.URL + "/organisms/1280"); err != nil {
+		t.Fatal(err)
+	}
+	var status OrganismStatus
+	if err = json.NewDecoder(response.Body).Decode(&status); err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if !reflect.DeepEqual(status.Profiles, []CgmlstSt{"A", "B", "C"}) {
+		t.Fatalf("Expected D to be removed again, got %v", status.Profiles)
+	}
+}
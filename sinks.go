@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Where the progress messages can be sent, as well as "fd:N", "unix:PATH" and "file:PATH"
+const (
+	PROGRESS_STDOUT = "stdout" // interleaved with the results (the default)
+	PROGRESS_STDERR = "stderr"
+	PROGRESS_NONE   = "none"
+)
+
+const PROGRESS_USAGE = "where to send the progress messages: stdout (with the results), stderr, none, fd:N, unix:PATH or file:PATH"
+
+const ENVELOPE_USAGE = "wrap each output document as {\"type\": ..., \"data\": ...}"
+
+// Document types in envelope mode
+const (
+	DOC_PROGRESS   = "progress"
+	DOC_EDGES      = "edges"
+	DOC_CLUSTERING = "clustering"
+	DOC_ERROR      = "error"
+	DOC_REJECTED   = "rejected"
+	DOC_DUPLICATES = "duplicates"
+	DOC_QC         = "qc"
+	DOC_SUMMARY    = "summary"
+	DOC_TEMPORAL   = "temporal"
+	DOC_RECOMMEND  = "recommend"
+	DOC_OTHER      = "other"
+)
+
+// Envelope wraps an output document so that consumers don't have to tell the documents apart by
+// their fields.
+type Envelope struct {
+	Type string      `json:"type"`
+	Data interface{} `json:"data"`
+}
+
+func documentType(doc interface{}) string {
+	switch d := doc.(type) {
+	case ProgressMessage:
+		return DOC_PROGRESS
+	case ClusterOutput:
+		if len(d.Edges) > 0 {
+			return DOC_EDGES
+		}
+		return DOC_CLUSTERING
+	case ErrorOutput:
+		return DOC_ERROR
+	case RejectedProfiles:
+		return DOC_REJECTED
+	case DuplicateProfiles:
+		return DOC_DUPLICATES
+	case QCReport:
+		return DOC_QC
+	case ClusterSummaries:
+		return DOC_SUMMARY
+	case TemporalClusters:
+		return DOC_TEMPORAL
+	case ThresholdReport:
+		return DOC_RECOMMEND
+	}
+	return DOC_OTHER
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error { return nil }
+
+// openProgressSink opens where the progress messages should be written.  It returns nil for stdout,
+// where they're interleaved with the results, and io.Discard for none.  A Unix socket should already
+// be listening.
+func openProgressSink(spec string) (io.WriteCloser, error) {
+	switch spec {
+	case "", PROGRESS_STDOUT:
+		return nil, nil
+	case PROGRESS_STDERR:
+		return nopCloser{os.Stderr}, nil
+	case PROGRESS_NONE:
+		return nopCloser{io.Discard}, nil
+	}
+	kind, target, _ := strings.Cut(spec, ":")
+	switch {
+	case target == "":
+	case kind == "fd":
+		fd, err := strconv.Atoi(target)
+		if err != nil || fd < 0 {
+			return nil, fmt.Errorf("invalid progress file descriptor '%s'", target)
+		}
+		f := os.NewFile(uintptr(fd), "progress")
+		if _, err = f.Stat(); err != nil {
+			return nil, fmt.Errorf("can't send progress to file descriptor %d: %w", fd, err)
+		}
+		return f, nil
+	case kind == "unix":
+		return net.Dial("unix", target)
+	case kind == "file":
+		return os.Create(target)
+	}
+	return nil, fmt.Errorf("unknown progress sink '%s', expected stdout, stderr, none, fd:N, unix:PATH or file:PATH", spec)
+}
+
+// documentEncoder writes the results, and the progress messages unless they have their own sink.
+// In envelope mode each document written to the results is wrapped with its type.
+type documentEncoder struct {
+	w        io.Writer
+	results  *json.Encoder
+	progress *json.Encoder
+	separate bool // the progress messages have their own sink
+	envelope bool
+}
+
+// newDocumentEncoder writes the progress messages to the results if sink is nil.
+func newDocumentEncoder(w io.Writer, sink io.Writer, envelope bool) *documentEncoder {
+	e := &documentEncoder{w: w, results: json.NewEncoder(w), envelope: envelope}
+	if sink == nil {
+		e.progress = e.results
+	} else {
+		e.progress = json.NewEncoder(sink)
+		e.separate = true
+	}
+	return e
+}
+
+func (e *documentEncoder) flush() {
+	if flusher, canFlush := e.w.(http.Flusher); canFlush {
+		flusher.Flush()
+	}
+}
+
+// encodeResult writes a document to the results.
+func (e *documentEncoder) encodeResult(doc interface{}) error {
+	if e.envelope {
+		doc = Envelope{documentType(doc), doc}
+	}
+	if err := e.results.Encode(doc); err != nil {
+		return err
+	}
+	e.flush()
+	return nil
+}
+
+// encodeProgress writes a progress message.  If its own sink fails the message is dropped, along
+// with any later ones, rather than stopping the run.
+func (e *documentEncoder) encodeProgress(message ProgressMessage) error {
+	if !e.separate {
+		return e.encodeResult(message)
+	}
+	if e.progress == nil {
+		return nil
+	}
+	if err := e.progress.Encode(message); err != nil {
+		log.Printf("Couldn't write the progress, no more will be sent: %s\n", err)
+		e.progress = nil
+	}
+	return nil
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+var sinkRequest = `{"STs": ["A", "B", "C", "D", "E"], "Threshold": 3}`
+
+// decodeMessages reads every document and splits the progress messages from the other documents.
+func decodeMessages(t *testing.T, r io.Reader) (progress []ProgressMessage, others []map[string]json.RawMessage) {
+	decoder := json.NewDecoder(r)
+	for {
+		var doc map[string]json.RawMessage
+		if err := decoder.Decode(&doc); err == io.EOF {
+			return
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if _, isProgress := doc["message"]; !isProgress {
+			others = append(others, doc)
+			continue
+		}
+		var message ProgressMessage
+		raw, _ := json.Marshal(doc)
+		if err := json.Unmarshal(raw, &message); err != nil {
+			t.Fatal(err)
+		}
+		progress = append(progress, message)
+	}
+}
+
+func checkFinalProgress(t *testing.T, progress []ProgressMessage) {
+	if len(progress) == 0 || progress[len(progress)-1].Progress != 100 {
+		t.Fatalf("Expected the progress to end at 100%%, got %+v", progress)
+	}
+}
+
+func TestEnvelope(t *testing.T) {
+	var output bytes.Buffer
+	if _, _, _, err := _main(context.Background(), fakeInput(sinkRequest, "{}", fakeProfiles), &output, Options{Envelope: true}); err != nil {
+		t.Fatal(err)
+	}
+	types := make([]string, 0)
+	decoder := json.NewDecoder(&output)
+	for {
+		var doc struct {
+			Type string
+			Data map[string]json.RawMessage
+		}
+		if err := decoder.Decode(&doc); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if doc.Data == nil {
+			t.Fatalf("Expected the document to be wrapped, got type '%s'", doc.Type)
+		}
+		if doc.Type != DOC_PROGRESS {
+			types = append(types, doc.Type)
+		}
+	}
+	expected := "edges edges edges edges clustering"
+	if strings.Join(types, " ") != expected {
+		t.Fatalf("Expected the documents %s, got %v", expected, types)
+	}
+
+	output.Reset()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, _, _, _ = _main(ctx, fakeInput(sinkRequest, "{}", fakeProfiles), &output, Options{Envelope: true, Progress: PROGRESS_NONE})
+	var last Envelope
+	lines := strings.Split(strings.TrimSpace(output.String()), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("Expected only the error document, got %v", lines)
+	}
+	if err := json.Unmarshal([]byte(lines[0]), &last); err != nil || last.Type != DOC_ERROR {
+		t.Fatalf("Expected an error document, got %s", lines[0])
+	}
+}
+
+func TestProgressFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "progress.json")
+	var output bytes.Buffer
+	if _, _, _, err := _main(context.Background(), fakeInput(sinkRequest, "{}", fakeProfiles), &output, Options{Progress: "file:" + path}); err != nil {
+		t.Fatal(err)
+	}
+	if progress, others := decodeMessages(t, &output); len(progress) > 0 || len(others) != 5 {
+		t.Fatalf("Expected only the results on stdout, got %d progress messages and %d others", len(progress), len(others))
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	progress, others := decodeMessages(t, f)
+	if len(others) > 0 {
+		t.Fatalf("Expected only progress in the file, got %v", others)
+	}
+	checkFinalProgress(t, progress)
+}
+
+func TestProgressFileDescriptor(t *testing.T) {
+	// A raw pipe so that only _main closes the write end
+	fds := make([]int, 2)
+	if err := syscall.Pipe(fds); err != nil {
+		t.Fatal(err)
+	}
+	reader := os.NewFile(uintptr(fds[0]), "progress")
+	defer reader.Close()
+	received := make(chan []ProgressMessage)
+	go func() {
+		progress, _ := decodeMessages(t, reader)
+		received <- progress
+	}()
+
+	var output bytes.Buffer
+	if _, _, _, err := _main(context.Background(), fakeInput(sinkRequest, "{}", fakeProfiles), &output, Options{Progress: "fd:" + strconv.Itoa(fds[1])}); err != nil {
+		t.Fatal(err)
+	}
+	checkFinalProgress(t, <-received)
+}
+
+func TestProgressSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "progress.sock")
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	received := make(chan []ProgressMessage)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			received <- nil
+			return
+		}
+		defer conn.Close()
+		progress, _ := decodeMessages(t, conn)
+		received <- progress
+	}()
+
+	var output bytes.Buffer
+	if _, _, _, err := _main(context.Background(), fakeInput(sinkRequest, "{}", fakeProfiles), &output, Options{Progress: "unix:" + path}); err != nil {
+		t.Fatal(err)
+	}
+	checkFinalProgress(t, <-received)
+}
+
+func TestInvalidProgressSink(t *testing.T) {
+	for _, spec := range []string{"fd:abc", "fd:", "carrier-pigeon", "unix:" + filepath.Join(t.TempDir(), "missing.sock")} {
+		var output bytes.Buffer
+		_, _, _, err := _main(context.Background(), fakeInput(sinkRequest, "{}", fakeProfiles), &output, Options{Progress: spec})
+		if pipelineErr, ok := err.(*PipelineError); !ok || pipelineErr.Code != OUTPUT_FAILED {
+			t.Fatalf("Expected '%s' to fail, got %v", spec, err)
+		}
+		if !strings.Contains(output.String(), `"OUTPUT_FAILED"`) {
+			t.Fatalf("Expected an error document for '%s', got %s", spec, output.String())
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"math"
 )
@@ -16,18 +17,29 @@ type Clusters struct {
 }
 
 type ClusterOutput struct {
-	Edges     map[int][][2]int `json:"edges"`
-	Pi        []int            `json:"pi"`
-	Lambda    []int            `json:"lambda"`
-	Sts       []string         `json:"STs"`
-	Threshold int              `json:"threshold"`
+	Edges      map[int][][2]int `json:"edges"`
+	Pi         []int            `json:"pi"`
+	Lambda     []int            `json:"lambda"`
+	Sts        []string         `json:"STs"`
+	Threshold  int              `json:"threshold"`
+	Linkage    string           `json:"linkage,omitempty"`    // only given if it isn't single linkage
+	Dendrogram []Merge          `json:"dendrogram,omitempty"` // only given if it isn't single linkage
+	Days       map[int][]int    `json:"days,omitempty"`       // days between the STs of each edge, -1 if unknown
 }
 
 func ClusterFromScratch(distances []int, nItems int) (c Clusters, err error) {
-	return ClusterFromCache(distances, nItems, NewCache())
+	return ClusterFromCache(context.Background(), distances, nItems, NewCache())
 }
 
-func ClusterFromCache(distances []int, nItems int, cache *Cache) (c Clusters, err error) {
+// ClusterFromCache extends the cached clustering with the remaining items.  It stops early with an
+// error if the context is cancelled.
+func ClusterFromCache(ctx context.Context, distances []int, nItems int, cache *Cache) (c Clusters, err error) {
+	return clusterFromCache(ctx, distances, nItems, cache, nil)
+}
+
+// clusterFromCache is ClusterFromCache which sends an STS_CLUSTERED event for each item if progress
+// isn't nil.
+func clusterFromCache(ctx context.Context, distances []int, nItems int, cache *Cache, progress chan ProgressEvent) (c Clusters, err error) {
 	if len(distances) != (nItems*(nItems-1))/2 {
 		err = errors.New("Wrong number of distances given")
 		return
@@ -60,21 +72,36 @@ func ClusterFromCache(distances []int, nItems int, cache *Cache) (c Clusters, er
 	// lambda[i] is the distance at which `i` would be clustered with something bigger than it
 	// pi[i] is the biggest object in the cluster it joins
 
-	M := make([]int, nItems)
 	mStart := nCacheItems * (nCacheItems - 1) / 2
 	mEnd := mStart
+	err = c.extend(ctx, nCacheItems, func(n int, M []int) {
+		// Here we set M to be each of the distances of things < n to n
+		// i.e. {(0, n), (1, n) ... (n-2, n-1)}
+		mStart, mEnd = mEnd, mEnd+n
+		copy(M, distances[mStart:mEnd])
+		if progress != nil {
+			progress <- ProgressEvent{STS_CLUSTERED, 1}
+		}
+	})
+	return
+}
+
+// extend runs SLINK for the items from `from` onwards.  row is called for each new item `n` and
+// should fill M with the distances from items 0 to n-1 to n.  The context is checked before each
+// item.
+func (c *Clusters) extend(ctx context.Context, from int, row func(n int, M []int)) error {
+	M := make([]int, c.nItems)
 
-	for n := nCacheItems; n < nItems; n++ {
+	for n := from; n < c.nItems; n++ {
+		if ctx.Err() != nil {
+			return cancelledError(ctx, PHASE_CLUSTERING)
+		}
 		// We build up pi and lambda by adding each datum in increasing size
 
 		// If the sequences are {a, b, c, d}
 		// the distances are:
 		// {(a,b), (a, c), (b, c), (a, d), (b, d), (c, d)}
-
-		// Here we set M to be each of the distances of things < n to n
-		// i.e. {(0, n), (1, n) ... (n-2, n-1)}
-		mStart, mEnd = mEnd, mEnd+n
-		copy(M, distances[mStart:mEnd])
+		row(n, M)
 
 		// The new node starts by pointing to itself and assumes no bigger nodes exist
 		c.pi[n] = n
@@ -101,29 +128,51 @@ func ClusterFromCache(distances []int, nItems int, cache *Cache) (c Clusters, er
 			}
 		}
 	}
-	return
+	return nil
+}
+
+// Format sends the edges at each distance up to the threshold and then the clustering.  The output
+// is closed early if the context is cancelled, so callers should check the context afterwards.
+func (c Clusters) Format(ctx context.Context, threshold int, distances []int, sts []CgmlstSt) (output chan ClusterOutput) {
+	return c.formatEdges(ctx, threshold, func(t int) [][2]int {
+		atThreshold := make([][2]int, 0, 100)
+		idx := 0
+		for i := 1; i < c.nItems; i++ {
+			for j := 0; j < i; j++ {
+				if distances[idx] == t {
+					atThreshold = append(atThreshold, [2]int{j, i})
+				}
+				idx++
+			}
+		}
+		return atThreshold
+	}, sts)
 }
 
-func (c Clusters) Format(threshold int, distances []int, sts []CgmlstSt) (output chan ClusterOutput) {
+// formatEdges is Format with the edges at each distance given by edgesAt rather than found in the
+// distances.
+func (c Clusters) formatEdges(ctx context.Context, threshold int, edgesAt func(t int) [][2]int, sts []CgmlstSt) (output chan ClusterOutput) {
 	output = make(chan ClusterOutput, 5)
+	send := func(doc ClusterOutput) bool {
+		if ctx.Err() != nil {
+			return false
+		}
+		select {
+		case output <- doc:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
 	go func() {
 		defer close(output)
 		for t := 0; t <= threshold; t++ {
-			edges := map[int][][2]int{}
-			atThreshold := make([][2]int, 0, 100)
-			idx := 0
-			for i := 1; i < c.nItems; i++ {
-				for j := 0; j < i; j++ {
-					if distances[idx] == t {
-						atThreshold = append(atThreshold, [2]int{j, i})
-					}
-					idx++
-				}
+			edges := map[int][][2]int{t: edgesAt(t)}
+			if !send(ClusterOutput{Edges: edges, Pi: []int{}, Lambda: []int{}, Sts: []CgmlstSt{}, Threshold: threshold}) {
+				return
 			}
-			edges[t] = atThreshold
-			output <- ClusterOutput{edges, []int{}, []int{}, []CgmlstSt{}, threshold}
 		}
-		output <- ClusterOutput{map[int][][2]int{}, c.pi, c.lambda, sts, threshold}
+		send(ClusterOutput{Edges: map[int][][2]int{}, Pi: c.pi, Lambda: c.lambda, Sts: sts, Threshold: threshold})
 	}()
 
 	return output
@@ -141,3 +190,11 @@ func (c Clusters) Get(threshold int) []int {
 	}
 	return clusterIDs
 }
+
+func countClusters(clusters []int) int {
+	seen := make(map[int]bool)
+	for _, c := range clusters {
+		seen[c] = true
+	}
+	return len(seen)
+}
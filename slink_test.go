@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"math/rand"
@@ -151,7 +152,7 @@ func TestUpdate(t *testing.T) {
 	for i := 0; i < 3; i++ {
 		distances[i] = -1
 	}
-	updated, err := ClusterFromCache(*distanceValues, len(scores.STs), &cache)
+	updated, err := ClusterFromCache(context.Background(), *distanceValues, len(scores.STs), &cache)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -202,7 +203,7 @@ func TestAnotherUpdate(t *testing.T) {
 	for i := 0; i < 3; i++ {
 		distances[i] = -1
 	}
-	updated, err := ClusterFromCache(*distanceValues, len(scores.STs), &cache)
+	updated, err := ClusterFromCache(context.Background(), *distanceValues, len(scores.STs), &cache)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -250,14 +251,6 @@ func checkClusters(t *testing.T, scores ScoresStore, clusters []int, threshold i
 	}
 }
 
-func countClusters(clusters []int) int {
-	seen := make(map[int]bool)
-	for _, c := range clusters {
-		seen[c] = true
-	}
-	return len(seen)
-}
-
 func TestRandomClusters(t *testing.T) {
 	for seed := int64(0); seed < 10; seed++ {
 		nScores := 1000
@@ -309,7 +302,7 @@ func TestLotsOfRandomClusters(t *testing.T) {
 func TestFormat(t *testing.T) {
 	clusters := Clusters{make([]int, 5), make([]int, 5), 5}
 	distances := []int{5, 1, 9, 6, 1, 2, 1, 2, 0, 7}
-	output := clusters.Format(5, distances, []CgmlstSt{"a", "b", "c", "d", "e"})
+	output := clusters.Format(context.Background(), 5, distances, []CgmlstSt{"a", "b", "c", "d", "e"})
 	expectedEdges := map[int][][2]int{
 		0: {{2, 4}},
 		1: {{0, 2}, {1, 3}, {0, 4}},
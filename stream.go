@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+)
+
+// streamRow is a row of distances which is scored by a worker and then clustered in order.
+type streamRow struct {
+	n     int
+	row   []int // the distances from STs 0 to n-1 to ST n
+	ready chan bool
+}
+
+// streamClustering scores and clusters the STs of a request which has already been through
+// requestedProfiles without keeping every distance.  SLINK takes each row as soon as it has been
+// scored, so only the rows being scored and the edges up to the threshold are held at once.  It
+// extends the cached clustering if it can be reused and returns the STs in the order they were
+// clustered with the edges at each distance up to the threshold, in the same order as Format.
+func streamClustering(ctx context.Context, request Request, cache *Cache, index *ProfilesMap, workers int, progress chan ProgressEvent) (STs []CgmlstSt, clusters Clusters, edges [][][2]int, err error) {
+	if workers <= 0 {
+		workers = runtime.NumCPU() + 1
+	}
+	canReuseCache, STs, _, cacheSize := sortSts(request.STs, cache, index)
+	if cached, _ := normaliseLinkage(cache.Linkage); cached != SINGLE_LINKAGE || cache.Threshold < request.Threshold {
+		canReuseCache = false
+	}
+
+	nItems := len(STs)
+	clusters = Clusters{pi: make([]int, nItems), lambda: make([]int, nItems), nItems: nItems}
+	edges = make([][][2]int, request.Threshold+1)
+	from := 0
+	if canReuseCache {
+		// The cached STs come first in the same order so the cached edges don't need mapping
+		from = cacheSize
+		copy(clusters.pi, cache.Pi)
+		copy(clusters.lambda, cache.Lambda)
+		for distance, pairs := range cache.Edges {
+			if distance < 0 || distance > request.Threshold {
+				continue
+			}
+			for _, pair := range pairs {
+				edges[distance] = append(edges[distance], [2]int{min(pair[0], pair[1]), max(pair[0], pair[1])})
+			}
+			sort.Slice(edges[distance], func(a, b int) bool {
+				x, y := edges[distance][a], edges[distance][b]
+				return x[1] < y[1] || (x[1] == y[1] && x[0] < y[0])
+			})
+		}
+	}
+	for t := range edges {
+		if edges[t] == nil {
+			edges[t] = make([][2]int, 0)
+		}
+	}
+	progress <- ProgressEvent{SCORES_EXPECTED, nItems * (nItems - 1) / 2}
+	progress <- ProgressEvent{CACHED_SCORES_EXPECTED, from * (from - 1) / 2}
+
+	profiles := make([]int, nItems)
+	for i, st := range STs {
+		profiles[i] = index.lookup[st]
+	}
+
+	// Rows are scored in parallel but no more than a couple per worker are held at once
+	jobs := make(chan *streamRow)
+	pending := make(chan *streamRow, 2*workers)
+	var running sync.WaitGroup
+	progress <- ProgressEvent{WORKERS_STARTED, workers}
+	for w := 0; w < workers; w++ {
+		running.Add(1)
+		go func(comparer *Comparer) {
+			defer running.Done()
+			for job := range jobs {
+				if ctx.Err() == nil {
+					started := time.Now()
+					for j := 0; j < job.n; j++ {
+						job.row[j] = comparer.compare(profiles[job.n], profiles[j])
+					}
+					progress <- ProgressEvent{WORKER_BUSY, int(time.Since(started))}
+				}
+				close(job.ready)
+			}
+		}(newComparer(*index))
+	}
+	go func() {
+		defer close(pending)
+		defer close(jobs)
+		for n := max(from, 1); n < nItems && ctx.Err() == nil; n++ {
+			job := &streamRow{n: n, row: make([]int, n), ready: make(chan bool)}
+			pending <- job
+			jobs <- job
+		}
+	}()
+	defer func() {
+		// Let the workers finish if SLINK stopped early
+		for job := range pending {
+			<-job.ready
+		}
+		running.Wait()
+		progress <- ProgressEvent{WORKERS_STOPPED, workers}
+	}()
+
+	err = clusters.extend(ctx, from, func(n int, M []int) {
+		if n == 0 {
+			return
+		}
+		job, more := <-pending
+		if !more {
+			return
+		}
+		<-job.ready
+		copy(M, job.row)
+		for j, distance := range job.row {
+			if distance <= request.Threshold {
+				edges[distance] = append(edges[distance], [2]int{j, n})
+			}
+		}
+		progress <- ProgressEvent{SCORE_CALCULATED, n}
+	})
+	if err == nil && ctx.Err() != nil {
+		err = cancelledError(ctx, PHASE_SCORING)
+	}
+	if err == nil {
+		// The STs were clustered as they were scored
+		progress <- ProgressEvent{CLUSTERING_STARTED, nItems - from}
+		progress <- ProgressEvent{STS_CLUSTERED, nItems - from}
+	}
+	return
+}
@@ -0,0 +1,138 @@
+package main
+
+import "sort"
+
+// ClusterSummary describes one cluster at a threshold.  Clusters are named after their last ST, as
+// in the other outputs.
+type ClusterSummary struct {
+	ID       CgmlstSt   `json:"id"`
+	Size     int        `json:"size"`
+	STs      []CgmlstSt `json:"STs"`
+	Diameter *int       `json:"diameter"` // the largest distance between two of its STs, null if one isn't known
+	Medoid   *CgmlstSt  `json:"medoid"`   // the ST with the smallest total distance to the others, null if one isn't known
+	Nearest  *int       `json:"nearest"`  // the distance to the closest other cluster, null if there are none
+}
+
+// ClusterSummaries is the optional output document with the clusters at a threshold.
+type ClusterSummaries struct {
+	Threshold int              `json:"threshold"`
+	Clusters  []ClusterSummary `json:"clusters"`
+}
+
+// Summarise describes each cluster at every threshold up to maxThreshold in one pass over the
+// distances.  Distances above known may be missing (because they were above the threshold of the
+// cache) so the nearest cluster is only given if it is within known.  A cluster can be chained
+// through STs whose distance wasn't in the cache, or which couldn't be compared, so its diameter and
+// medoid are only given if every distance within it is known.
+func (c Clusters) Summarise(maxThreshold int, distances []int, STs []CgmlstSt, known int) []ClusterSummaries {
+	levels := maxThreshold + 1
+	ids := make([][]int, levels)
+	clusterOf := make([]map[int]int, levels) // index into summaries of each cluster id
+	roots := make([][]int, levels)           // the id of each cluster
+	summaries := make([][]ClusterSummary, levels)
+	nearest := make([][]int, levels)
+	diameters := make([][]int, levels)
+	unknown := make([][]bool, levels) // some of the distances within the cluster are missing
+	totals := make([][]int, levels)   // distance from each ST to the rest of its cluster
+	for t := range ids {
+		ids[t] = c.Get(t)
+		clusterOf[t] = make(map[int]int)
+		summaries[t] = make([]ClusterSummary, 0)
+		for i, id := range ids[t] {
+			k, found := clusterOf[t][id]
+			if !found {
+				k = len(summaries[t])
+				clusterOf[t][id] = k
+				roots[t] = append(roots[t], id)
+				summaries[t] = append(summaries[t], ClusterSummary{ID: STs[id], STs: []CgmlstSt{}})
+				nearest[t] = append(nearest[t], ALMOST_INF)
+				diameters[t] = append(diameters[t], 0)
+				unknown[t] = append(unknown[t], false)
+			}
+			summaries[t][k].STs = append(summaries[t][k].STs, STs[i])
+			summaries[t][k].Size++
+		}
+		totals[t] = make([]int, c.nItems)
+	}
+
+	// Each distance is added to the smallest cluster which holds the pair and to the largest clusters
+	// which separate them
+	idx := 0
+	for b := 1; b < c.nItems; b++ {
+		for a := 0; a < b; a++ {
+			distance := distances[idx]
+			idx++
+			joined := sort.Search(levels, func(t int) bool { return ids[t][a] == ids[t][b] })
+			if joined < levels {
+				k := clusterOf[joined][ids[joined][a]]
+				if distance >= ALMOST_INF {
+					unknown[joined][k] = true
+				} else {
+					totals[joined][a] += distance
+					totals[joined][b] += distance
+					if distance > diameters[joined][k] {
+						diameters[joined][k] = distance
+					}
+				}
+			}
+			if joined == 0 {
+				continue
+			}
+			t := joined - 1
+			ka, kb := clusterOf[t][ids[t][a]], clusterOf[t][ids[t][b]]
+			if distance < nearest[t][ka] {
+				nearest[t][ka] = distance
+			}
+			if distance < nearest[t][kb] {
+				nearest[t][kb] = distance
+			}
+		}
+	}
+
+	// and then to the clusters at the other thresholds which hold the same pair or separate it
+	for t := 1; t < levels; t++ {
+		for k, root := range roots[t-1] {
+			parent := clusterOf[t][ids[t][root]]
+			if diameters[t-1][k] > diameters[t][parent] {
+				diameters[t][parent] = diameters[t-1][k]
+			}
+			unknown[t][parent] = unknown[t][parent] || unknown[t-1][k]
+		}
+		for i := range totals[t] {
+			totals[t][i] += totals[t-1][i]
+		}
+	}
+	for t := levels - 2; t >= 0; t-- {
+		for k, root := range roots[t] {
+			if parent := clusterOf[t+1][ids[t+1][root]]; nearest[t+1][parent] < nearest[t][k] {
+				nearest[t][k] = nearest[t+1][parent]
+			}
+		}
+	}
+
+	output := make([]ClusterSummaries, levels)
+	for t := range output {
+		best := make([]int, len(summaries[t]))
+		for k := range best {
+			best[k] = -1
+		}
+		for i, id := range ids[t] {
+			k := clusterOf[t][id]
+			if best[k] < 0 || totals[t][i] < totals[t][best[k]] {
+				best[k] = i
+			}
+		}
+		for k := range summaries[t] {
+			if !unknown[t][k] {
+				diameter, medoid := diameters[t][k], STs[best[k]]
+				summaries[t][k].Diameter, summaries[t][k].Medoid = &diameter, &medoid
+			}
+			if nearest[t][k] <= known && nearest[t][k] < ALMOST_INF {
+				distance := nearest[t][k]
+				summaries[t][k].Nearest = &distance
+			}
+		}
+		output[t] = ClusterSummaries{t, summaries[t]}
+	}
+	return output
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSummarise(t *testing.T) {
+	// A-1-B-2-C-1-E
+	//         |
+	//         3-D
+	distances := []int{
+		1,
+		3, 2,
+		5, 4, 3,
+		3, 3, 1, 4,
+	}
+	STs := []CgmlstSt{"A", "B", "C", "D", "E"}
+	clusters, err := ClusterFromScratch(distances, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	all := clusters.Summarise(2, distances, STs, ALMOST_INF)
+	summaries := all[2]
+	zero, two, three := 0, 2, 3
+	b, d := CgmlstSt("B"), CgmlstSt("D")
+	expected := ClusterSummaries{2, []ClusterSummary{
+		{"E", 4, []CgmlstSt{"A", "B", "C", "E"}, &three, &b, &three},
+		{"D", 1, []CgmlstSt{"D"}, &zero, &d, &three},
+	}}
+	if !reflect.DeepEqual(summaries, expected) {
+		t.Fatalf("Expected %v, got %v", expected, summaries)
+	}
+
+	// Every ST is on its own at 0 and C joins E at 1
+	one := 1
+	a, c, e := CgmlstSt("A"), CgmlstSt("C"), CgmlstSt("E")
+	expected = ClusterSummaries{1, []ClusterSummary{
+		{"B", 2, []CgmlstSt{"A", "B"}, &one, &a, &two},
+		{"E", 2, []CgmlstSt{"C", "E"}, &one, &c, &two},
+		{"D", 1, []CgmlstSt{"D"}, &zero, &d, &three},
+	}}
+	if !reflect.DeepEqual(all[1], expected) {
+		t.Fatalf("Expected %v, got %v", expected, all[1])
+	}
+	if len(all[0].Clusters) != 5 || *all[0].Clusters[4].Nearest != 1 || *all[0].Clusters[4].Medoid != e {
+		t.Fatalf("Expected singletons at 0, got %+v", all[0])
+	}
+
+	// The distances above 2 might not be known
+	summaries = clusters.Summarise(2, distances, STs, 2)[2]
+	if summaries.Clusters[0].Nearest != nil {
+		t.Fatalf("Expected the nearest cluster to be unknown, got %d", *summaries.Clusters[0].Nearest)
+	}
+
+	// A reused cache doesn't know that A and C, which are chained through B, are 3 apart
+	cached := append([]int{}, distances...)
+	cached[1] = ALMOST_INF
+	summaries = clusters.Summarise(2, cached, STs, 2)[2]
+	if first := summaries.Clusters[0]; first.Diameter != nil || first.Medoid != nil {
+		t.Fatalf("Expected the diameter and medoid to be unknown, got %+v", first)
+	}
+	if second := summaries.Clusters[1]; second.Diameter == nil || *second.Diameter != 0 || *second.Medoid != "D" {
+		t.Fatalf("Expected the singleton to be summarised, got %+v", second)
+	}
+}